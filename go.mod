@@ -1,3 +1,15 @@
 module github.com/abdealijaroli/godfs
 
 go 1.22.0
+
+require (
+	github.com/google/btree v1.1.3
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	go.etcd.io/bbolt v1.3.11
+	google.golang.org/protobuf v1.36.6
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
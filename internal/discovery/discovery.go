@@ -2,11 +2,16 @@ package discovery
 
 import (
 	"sync"
+
+	"github.com/abdealijaroli/godfs/pkg/p2p"
 )
 
 type Peer struct {
 	Address string
 	Active  bool
+
+	// open transport connections to this address
+	conns int
 }
 
 type PeerDiscovery struct {
@@ -39,3 +44,38 @@ func (pd *PeerDiscovery) GetPeers() []string {
 	}
 	return peerList
 }
+
+// keeps peers in sync with t's connections, a peer is active while at least
+// one connection to it is up and turns inactive once heartbeats or errors
+// have taken the last one down
+func (pd *PeerDiscovery) Track(t p2p.Transport) {
+	t.OnPeerConnected(func(peer p2p.Peer) {
+		pd.Lock.Lock()
+		defer pd.Lock.Unlock()
+
+		addr := peer.RemoteAddr()
+		p, exists := pd.Peers[addr]
+		if !exists {
+			p = &Peer{Address: addr}
+			pd.Peers[addr] = p
+		}
+		p.conns++
+		p.Active = true
+	})
+
+	t.OnPeerDisconnected(func(peer p2p.Peer) {
+		pd.Lock.Lock()
+		defer pd.Lock.Unlock()
+
+		p, exists := pd.Peers[peer.RemoteAddr()]
+		if !exists {
+			return
+		}
+		if p.conns > 0 {
+			p.conns--
+		}
+		if p.conns == 0 {
+			p.Active = false
+		}
+	})
+}
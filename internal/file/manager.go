@@ -1,6 +1,7 @@
 package file
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -112,7 +113,7 @@ func (fm *FileManager) DownloadFile(outputPath string, chunkIDs []string, encryp
 	defer outputFile.Close()
 
 	for _, chunkID := range chunkIDs {
-		chunkPath, err := fm.DHT.Get(chunkID)
+		chunkPath, err := fm.DHT.Get(context.Background(), chunkID, node.ReadOpts{})
 		if err != nil {
 			return err
 		}
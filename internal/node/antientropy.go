@@ -0,0 +1,166 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+const (
+	msgTree     = "dht_tree"
+	msgTreeDiff = "dht_tree_diff"
+	msgSync     = "dht_sync"
+	msgSynced   = "dht_synced"
+
+	// how often each co-replica is compared by default
+	DefaultAntiEntropyInterval = 30 * time.Second
+)
+
+// compares trees with every co-replica each interval and exchanges the keys
+// that differ, so replicas that missed writes converge
+func WithAntiEntropy(interval time.Duration) Option {
+	return func(d *DHT) {
+		d.antiEntropyInterval = interval
+	}
+}
+
+type treeRequest struct {
+	Root []byte `json:"root"`
+}
+
+type treeResponse struct {
+	InSync bool     `json:"in_sync"`
+	Leaves [][]byte `json:"leaves,omitempty"`
+}
+
+type syncMessage struct {
+	Leaves  []int                `json:"leaves"`
+	Entries map[string]DataEntry `json:"entries"`
+}
+
+// whether key is owned by both this node and peer
+func (d *DHT) sharedWith(peer string) func(key string) bool {
+	return func(key string) bool {
+		self, other := false, false
+		for _, o := range d.OwnersOf(key, d.replicationFactor) {
+			self = self || o == d.selfNode
+			other = other || o == peer
+		}
+		return self && other
+	}
+}
+
+// our live copies of the keys in leaves that peer owns as well
+func (d *DHT) entriesIn(leaves []int, peer string) map[string]DataEntry {
+	out := make(map[string]DataEntry)
+	for _, key := range d.merkle.keys(leaves, d.sharedWith(peer)) {
+		// expired entries are left to each node's reaper
+		if entry, ok := d.getLocal(key); ok {
+			out[key] = entry
+		}
+	}
+	return out
+}
+
+// compares the keys this node shares with peer and exchanges those that
+// differ in both directions. Returns how many entries were sent and received.
+func (d *DHT) SyncWith(ctx context.Context, peer string) (int, error) {
+	tree := d.merkle.tree(peer, d.sharedWith(peer))
+
+	var treeResp treeResponse
+	if err := d.request(ctx, peer, msgTree, treeRequest{Root: tree.Root()}, msgTreeDiff, &treeResp); err != nil {
+		return 0, err
+	}
+	if treeResp.InSync {
+		return 0, nil
+	}
+
+	leaves := tree.Diff(treeResp.Leaves)
+	if len(leaves) == 0 {
+		return 0, nil
+	}
+	out := d.entriesIn(leaves, peer)
+
+	var theirs syncMessage
+	if err := d.request(ctx, peer, msgSync, syncMessage{Leaves: leaves, Entries: out}, msgSynced, &theirs); err != nil {
+		return 0, err
+	}
+	for key, entry := range theirs.Entries {
+		if err := d.apply(key, entry); err != nil {
+			return 0, err
+		}
+	}
+	return len(out) + len(theirs.Entries), nil
+}
+
+// answers a tree comparison with our leaves unless the roots already match
+func (d *DHT) handleTree(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req treeRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode tree payload: %v", err)
+	}
+
+	tree := d.merkle.tree(msg.Sender, d.sharedWith(msg.Sender))
+	resp := treeResponse{InSync: bytes.Equal(tree.Root(), req.Root)}
+	if !resp.InSync {
+		resp.Leaves = tree.Leaves()
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.Message{Type: msgTreeDiff, Payload: data}, nil
+}
+
+// takes the peer's entries for the differing leaves and answers with ours
+func (d *DHT) handleSync(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req syncMessage
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode sync payload: %v", err)
+	}
+
+	// collect ours before merging theirs so we don't echo their versions back
+	ours := d.entriesIn(req.Leaves, msg.Sender)
+	for key, entry := range req.Entries {
+		if err := d.apply(key, entry); err != nil {
+			return p2p.Message{}, err
+		}
+	}
+
+	data, err := json.Marshal(syncMessage{Leaves: req.Leaves, Entries: ours})
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.Message{Type: msgSynced, Payload: data}, nil
+}
+
+// syncs with every node that shares keys with us each interval until the DHT
+// closes
+func (d *DHT) antiEntropyLoop() {
+	ticker := time.NewTicker(d.antiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, peer := range d.ring.CoReplicas(d.selfNode, d.replicationFactor) {
+			n, err := d.SyncWith(context.Background(), peer)
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				log.Printf("Anti-entropy with %s exchanged %d entries", peer, n)
+			}
+		}
+	}
+}
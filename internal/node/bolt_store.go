@@ -0,0 +1,103 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("entries")
+
+// a Store kept in a single bbolt file. Every write is its own fsynced
+// transaction and only the pages being read are held in memory, which suits
+// nodes holding more keys than fit in RAM.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create bucket: %v", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(key string) (DataEntry, bool, error) {
+	var entry DataEntry
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(boltBucket).Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(raw, &entry)
+	})
+	return entry, found, err
+}
+
+func (s *BoltStore) Put(key string, entry DataEntry) error {
+	var b Batch
+	b.Put(key, entry)
+	return s.Batch(&b)
+}
+
+func (s *BoltStore) Delete(key string) error {
+	var b Batch
+	b.Delete(key)
+	return s.Batch(&b)
+}
+
+// fn runs inside a read transaction and must not write to the store
+func (s *BoltStore) Iterate(start string, fn func(key string, entry DataEntry) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			var entry DataEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("decode %s: %v", k, err)
+			}
+			if !fn(string(k), entry) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Batch(b *Batch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range b.ops {
+			if op.Delete {
+				if err := bucket.Delete([]byte(op.Key)); err != nil {
+					return err
+				}
+				continue
+			}
+			raw, err := json.Marshal(op.Entry)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(op.Key), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,181 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+const (
+	msgCAS       = "dht_cas"
+	msgCASResult = "dht_cas_result"
+)
+
+// returned when a conditional write finds another version than it expected
+var ErrVersionMismatch = errors.New("version mismatch")
+
+type casRequest struct {
+	Key string `json:"key"`
+	// the Context of the value the swap replaces
+	Expected VectorClock `json:"expected"`
+	Entry    DataEntry   `json:"entry"`
+}
+
+type casResponse struct {
+	Applied bool `json:"applied"`
+	// the version the replica holds, see versionOf
+	Version int64 `json:"version"`
+}
+
+// sets key to newValue only if its Version is still expectedVersion, as read
+// with GetVersions. Every owner taking the write checks that it holds nothing
+// the value read didn't include, so of several swaps from the same value at
+// most one is acknowledged by a majority of them; W must be a majority, the
+// default, for that to hold. A swap rejected with ErrVersionMismatch may
+// still have reached a minority of the owners, where it remains as a sibling
+// of the winner. The next swap from a value with siblings replaces them all.
+func (d *DHT) CompareAndSwap(ctx context.Context, key string, expectedVersion int64, newValue string, opts WriteOpts) error {
+	n, w := d.quorum(opts.N, opts.W)
+	owners, err := d.FindOwners(ctx, key, n)
+	if err != nil {
+		return err
+	}
+	if len(owners) < w {
+		return fmt.Errorf("%w: %d replicas known, %d acks required", ErrQuorum, len(owners), w)
+	}
+
+	current, err := d.GetVersions(ctx, key, ReadOpts{N: n})
+	found := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if version := versionOf(current, found); version != expectedVersion {
+		return fmt.Errorf("%w: expected %d, found %d", ErrVersionMismatch, expectedVersion, version)
+	}
+	expected := current.Context()
+	entry := d.newEntry(newValue, expected)
+	if opts.TTL > 0 {
+		entry.ExpiresAt = entry.Timestamp.Add(opts.TTL)
+	}
+
+	results := make(chan casReply, len(owners))
+	for _, node := range owners {
+		if node == d.selfNode {
+			applied, version, err := d.applyIfVersion(key, expected, entry)
+			results <- casReply{node: node, resp: casResponse{Applied: applied, Version: version}, err: err}
+			continue
+		}
+		go func(node string) {
+			var resp casResponse
+			req := casRequest{Key: key, Expected: expected, Entry: entry}
+			err := d.request(context.Background(), node, msgCAS, req, msgCASResult, &resp)
+			results <- casReply{node: node, resp: resp, err: err}
+		}(node)
+	}
+
+	acks := 0
+	var rejected []string
+	var errs []error
+	for range owners {
+		var res casReply
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		switch {
+		case res.err != nil:
+			errs = append(errs, fmt.Errorf("%s: %v", res.node, res.err))
+		case !res.resp.Applied:
+			rejected = append(rejected, fmt.Sprintf("%s holds %d", res.node, res.resp.Version))
+		default:
+			acks++
+		}
+		if acks >= w {
+			return nil
+		}
+		if len(owners)-len(errs)-len(rejected) < w {
+			break
+		}
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("%w: %d of %d acks, %s", ErrVersionMismatch, acks, w, strings.Join(rejected, ", "))
+	}
+	return fmt.Errorf("%w: %d of %d acks: %v", ErrQuorum, acks, w, errors.Join(errs...))
+}
+
+// sets key only if none of the replicas taking the write hold a value for it,
+// see CompareAndSwap
+func (d *DHT) PutIfAbsent(ctx context.Context, key, value string, opts WriteOpts) error {
+	return d.CompareAndSwap(ctx, key, 0, value, opts)
+}
+
+type casReply struct {
+	node string
+	resp casResponse
+	err  error
+}
+
+// the version a swap must expect to replace e, 0 when the key has no value.
+// With concurrent versions it is the primary one's, a swap from it replaces
+// the siblings too.
+func versionOf(e DataEntry, found bool) int64 {
+	if !found {
+		return 0
+	}
+	return e.Version
+}
+
+// applies entry only if we hold no version of key that expected, the context
+// the swap was read with, doesn't cover. Returns the version found otherwise.
+func (d *DHT) applyIfVersion(key string, expected VectorClock, entry DataEntry) (bool, int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	current, found := d.getLocal(key)
+	if found {
+		current, found = visibleEntry(current)
+	}
+	version := versionOf(current, found)
+	if found {
+		for _, v := range current.Versions() {
+			if v.Clock.Compare(entry.Clock) == Equal {
+				// read repair or anti-entropy delivered this very swap already
+				return true, version, nil
+			}
+		}
+		if ord := current.Context().Compare(expected); ord != Equal && ord != Before {
+			return false, version, nil
+		}
+	}
+	if err := d.applyLocked(key, entry); err != nil {
+		return false, 0, err
+	}
+	return true, version, nil
+}
+
+// applies a conditional write from another node
+func (d *DHT) handleCAS(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req casRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode cas payload: %v", err)
+	}
+	if req.Key == "" {
+		return p2p.Message{}, errors.New("cas payload missing key")
+	}
+
+	applied, version, err := d.applyIfVersion(req.Key, req.Expected, req.Entry)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	data, err := json.Marshal(casResponse{Applied: applied, Version: version})
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.Message{Type: msgCASResult, Payload: data}, nil
+}
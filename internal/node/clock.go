@@ -0,0 +1,153 @@
+package node
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// causal history of a value, one counter per node that coordinated a write
+// to it. Counters are ticks from the node's clock source rather than plain
+// sequence numbers, so a restarted node usually carries on above its old
+// ones; when its clock has gone back a write still counts on from the
+// counter in its context, see ticker.tick.
+type VectorClock map[string]uint64
+
+// how two clocks relate
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+func (vc VectorClock) Copy() VectorClock {
+	out := make(VectorClock, len(vc))
+	for node, n := range vc {
+		out[node] = n
+	}
+	return out
+}
+
+// the smallest clock that descends from both vc and other
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	out := vc.Copy()
+	for node, n := range other {
+		if n > out[node] {
+			out[node] = n
+		}
+	}
+	return out
+}
+
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	less, greater := false, false
+	for node, n := range vc {
+		if m := other[node]; n < m {
+			less = true
+		} else if n > m {
+			greater = true
+		}
+	}
+	for node, m := range other {
+		if _, ok := vc[node]; !ok && m > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// every value of the entry, the primary one first
+func (e DataEntry) Versions() []DataEntry {
+	primary := e
+	primary.Siblings = nil
+	return append([]DataEntry{primary}, e.Siblings...)
+}
+
+// the clock a write that supersedes every version of e must descend from
+func (e DataEntry) Context() VectorClock {
+	clock := e.Clock.Copy()
+	for _, s := range e.Siblings {
+		clock = clock.Merge(s.Clock)
+	}
+	return clock
+}
+
+// combines two replicas' views of a key, dropping every version another one
+// descends from. Concurrent versions are kept as siblings behind the latest
+// write, ties broken by value so every replica picks the same primary.
+func mergeEntries(a, b DataEntry) DataEntry {
+	versions := append(a.Versions(), b.Versions()...)
+
+	var kept []DataEntry
+	for i, v := range versions {
+		dominated := false
+		for j, other := range versions {
+			if i == j {
+				continue
+			}
+			switch v.Clock.Compare(other.Clock) {
+			case Before:
+				dominated = true
+			case Equal:
+				// the same write seen twice
+				dominated = dominated || j < i
+			}
+		}
+		if !dominated {
+			kept = append(kept, v)
+		}
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		if !kept[i].Timestamp.Equal(kept[j].Timestamp) {
+			return kept[i].Timestamp.After(kept[j].Timestamp)
+		}
+		return kept[i].Value < kept[j].Value
+	})
+	out := kept[0]
+	if len(kept) > 1 {
+		out.Siblings = kept[1:]
+	}
+	return out
+}
+
+// picks the value to return when a key has concurrent versions, versions has
+// the primary first. Applications that can merge values, like sets of chunk
+// locations, should do so here and write the result back with Put using the
+// entry's Context.
+type Resolver func(key string, versions []DataEntry) string
+
+// hands out strictly increasing counters for this node's clock entries
+type ticker struct {
+	lock sync.Mutex
+	last uint64
+}
+
+// the next counter, above both the previous one and after, the counter a
+// write's context already holds for this node
+func (t *ticker) tick(after uint64) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if after > t.last {
+		t.last = after
+	}
+	now := uint64(time.Now().UnixNano())
+	if now <= t.last {
+		now = t.last + 1
+	}
+	t.last = now
+	return now
+}
@@ -1,11 +1,13 @@
 package node
 
 import (
-	// "crypto/tls"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"log"
 	"sync"
 	"time"
 
@@ -13,29 +15,251 @@ import (
 )
 
 type DHT struct {
-	data      map[string]DataEntry
+	store     Store
 	nodes     []string
 	selfNode  string
 	lock      sync.RWMutex
-	transport *p2p.TCPTransport
+	transport p2p.Transport
+
+	requestTimeout    time.Duration
+	replicationFactor int
+	ring              *Ring
+	merkle            *merkleIndex
+	routing           *RoutingTable
+	clock             ticker
+	resolver          Resolver
+	metrics           metrics
+
+	antiEntropyInterval time.Duration
+
+	hintedHandoff bool
+	hintInterval  time.Duration
+	hintsLock     sync.Mutex
+	// owner -> key -> the newest write owner hasn't acknowledged
+	hints map[string]map[string]DataEntry
+
+	dataDir          string
+	snapshotInterval time.Duration
+
+	reapInterval   time.Duration
+	tombstoneGrace time.Duration
+
+	watchLock   sync.Mutex
+	watches     map[string]*watch
+	subscribers map[string]*subscriber
+
+	done      chan struct{}
+	closeOnce sync.Once
+	vnodes    int
+
+	// applied when the default TCP transport is created
+	tcpOpts []p2p.TCPOption
+}
+
+type Option func(*DHT)
+
+// talks to other nodes over t instead of a TCP transport listening on selfNode
+func WithTransport(t p2p.Transport) Option {
+	return func(d *DHT) {
+		d.transport = t
+	}
+}
+
+// sets how many tokens each node gets on the hash ring, every node in a
+// cluster must use the same value for placement to agree
+func WithVirtualNodes(n int) Option {
+	return func(d *DHT) {
+		d.vnodes = n
+	}
+}
+
+// sets how many nodes own each key, Get asks that many replicas
+func WithReplicationFactor(n int) Option {
+	return func(d *DHT) {
+		d.replicationFactor = n
+	}
+}
+
+// settles keys with concurrent versions on Get, without one the latest
+// write is returned and the others are kept as siblings
+func WithResolver(r Resolver) Option {
+	return func(d *DHT) {
+		d.resolver = r
+	}
+}
+
+// bounds how long a single request to another node may take
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(d *DHT) {
+		d.requestTimeout = timeout
+	}
+}
+
+// secures node-to-node traffic, see config.LoadTLSConfig for a mutual TLS config
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(d *DHT) {
+		d.tcpOpts = append(d.tcpOpts, p2p.WithTLSConfig(cfg))
+	}
+}
+
+// sets the codecs node-to-node traffic may use, most preferred first, e.g.
+// p2p.CodecJSON alone to keep messages readable while debugging
+func WithCodecs(names ...string) Option {
+	return func(d *DHT) {
+		d.tcpOpts = append(d.tcpOpts, p2p.WithCodecs(names...))
+	}
 }
 
 type DataEntry struct {
-	Value     string
+	Value string
+	// the coordinator's tick for the write that produced Value
 	Version   int64
 	Timestamp time.Time
+	Clock     VectorClock `json:",omitempty"`
+	// concurrent writes that neither descends from, see Resolver
+	Siblings []DataEntry `json:",omitempty"`
+	// when this version stops being returned, zero if it never expires
+	ExpiresAt time.Time
+	// marks a tombstone left by Delete, its ExpiresAt ends the grace period
+	Deleted bool `json:",omitempty"`
+}
+
+// returned by reads of a key that is absent, expired or deleted
+var ErrNotFound = errors.New("key not found")
+
+const (
+	msgStore = "dht_store"
+	msgAck   = "ack"
+	msgGet   = "dht_get"
+	msgEntry = "dht_entry"
+
+	// how long to wait for a node to answer a single request by default
+	DefaultRequestTimeout = 5 * time.Second
+	// nodes owning each key by default
+	DefaultReplicationFactor = 3
+)
+
+// creates a DHT for selfNode that keeps its data in memory, see OpenDHT for
+// other stores
+func NewDHT(selfNode string, opts ...Option) *DHT {
+	d := newDHT(selfNode, opts)
+	d.store = NewMemStore()
+	d.merkle = newMerkleIndex()
+	d.start()
+	return d
+}
+
+// creates a DHT for selfNode that keeps its data where storage says, reading
+// back what is there first. A nil storage keeps it in memory.
+func OpenDHT(selfNode string, storage StoreOption, opts ...Option) (*DHT, error) {
+	d := newDHT(selfNode, opts)
+	if storage != nil {
+		storage(d)
+	}
+	if d.store == nil && d.dataDir != "" {
+		s, err := OpenWALStore(d.dataDir, d.snapshotInterval)
+		if err != nil {
+			return nil, fmt.Errorf("recover %s: %v", d.dataDir, err)
+		}
+		d.store = s
+	}
+	if err := d.index(); err != nil {
+		d.store.Close()
+		return nil, fmt.Errorf("index data: %v", err)
+	}
+	d.start()
+	return d, nil
+}
+
+func newDHT(selfNode string, opts []Option) *DHT {
+	d := &DHT{
+		nodes:             []string{},
+		selfNode:          selfNode,
+		requestTimeout:    DefaultRequestTimeout,
+		replicationFactor: DefaultReplicationFactor,
+		vnodes:            DefaultVirtualNodes,
+		reapInterval:      DefaultReapInterval,
+		tombstoneGrace:    DefaultTombstoneGrace,
+		done:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// builds the anti-entropy index from the store, from here on it follows
+// every change, see changed
+func (d *DHT) index() error {
+	if d.store == nil {
+		d.store = NewMemStore()
+	}
+	d.merkle = newMerkleIndex()
+	return d.store.Iterate("", func(key string, entry DataEntry) bool {
+		d.merkle.update(key, entry, true)
+		return true
+	})
 }
 
-func NewDHT(selfNode string) *DHT {
-	return &DHT{
-		data:      make(map[string]DataEntry),
-		nodes:     []string{},
-		selfNode:  selfNode,
-		transport: p2p.NewTCPTransport(selfNode),
+// sets up placement and the transport's handlers and starts the background
+// loops
+func (d *DHT) start() {
+	d.ring = NewRing(d.vnodes)
+	d.ring.Add(d.selfNode)
+	d.routing = NewRoutingTable(d.selfNode)
+	if d.transport == nil {
+		d.transport = p2p.NewTCPTransport(d.selfNode, d.tcpOpts...)
+	}
+	d.transport.Handle(msgStore, d.handleStore)
+	d.transport.Handle(msgGet, d.handleGet)
+	d.transport.Handle(msgCAS, d.handleCAS)
+	d.transport.Handle(msgFindNode, d.handleFind)
+	d.transport.Handle(msgFindValue, d.handleFind)
+	d.transport.Handle(msgTree, d.handleTree)
+	d.transport.Handle(msgSync, d.handleSync)
+	d.transport.Handle(msgWatch, d.handleWatch)
+	d.transport.Handle(msgUnwatch, d.handleUnwatch)
+	d.transport.Handle(msgEvent, d.handleEvent)
+	d.transport.OnPeerConnected(d.onWatchPeerConnected)
+	if d.reapInterval > 0 {
+		go d.reapLoop()
+	}
+	if d.antiEntropyInterval > 0 {
+		go d.antiEntropyLoop()
 	}
+	if d.hintedHandoff {
+		d.transport.OnPeerConnected(d.onPeerConnected)
+		go d.replayLoop()
+	}
+}
+
+// serves requests from other nodes until the transport is closed
+func (d *DHT) ListenAndAccept() error {
+	return d.transport.ListenAndAccept()
 }
 
+// stops serving and closes the store, including one given with WithStore
+func (d *DHT) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		err = errors.Join(d.transport.Close(), d.store.Close())
+	})
+	return err
+}
+
+// records node as a routing contact, called for seeds and for every node
+// that answers us. When its k-bucket is full the bucket's oldest contact is
+// pinged first and node is only added if that one is gone.
 func (d *DHT) AddNode(node string) {
+	if node == d.selfNode {
+		return
+	}
+	if oldest, full := d.routing.Update(node); full {
+		go d.challenge(oldest, node)
+		return
+	}
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	for _, n := range d.nodes {
@@ -44,122 +268,184 @@ func (d *DHT) AddNode(node string) {
 		}
 	}
 	d.nodes = append(d.nodes, node)
+	d.ring.Add(node)
+	d.merkle.invalidate()
+	go d.resubscribe(node)
 }
 
-func (d *DHT) ListNodes() []string {
+func (d *DHT) isMember(node string) bool {
 	d.lock.RLock()
 	defer d.lock.RUnlock()
-	return append([]string{}, d.nodes...)
-}
-
-func (d *DHT) GetAllData() map[string]interface{} {
-	d.lock.RLock()
-	defer d.lock.RUnlock()
-	data := make(map[string]interface{})
-	for k, v := range d.data {
-		data[k] = v
+	for _, n := range d.nodes {
+		if n == node {
+			return true
+		}
 	}
-	return data
+	return false
 }
 
-func (d *DHT) Remove(key string) error {
+// forgets a contact evicted from the routing table
+func (d *DHT) removeMember(node string) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	for i, n := range d.nodes {
+		if n == node {
+			d.nodes = append(d.nodes[:i:i], d.nodes[i+1:]...)
+			d.ring.Remove(node)
+			d.merkle.invalidate()
+			return
+		}
+	}
+}
 
-	if _, exists := d.data[key]; !exists {
-		return errors.New("key not found")
+// the routing contacts of this node, closest to target first
+func (d *DHT) Contacts(target NodeID) []string {
+	var addrs []string
+	for _, c := range d.routing.Closest(target, d.routing.Len()) {
+		addrs = append(addrs, c.Addr)
 	}
+	return addrs
+}
 
-	delete(d.data, key)
-	return nil
+// the n nodes responsible for key, primary owner first: of the BucketSize
+// nodes closest to the key by XOR distance, the first n on the ring. This
+// only consults our own contacts, which in a cluster larger than a k-bucket
+// may miss some of those nodes, FindOwners looks them up.
+func (d *DHT) OwnersOf(key string, n int) []string {
+	return d.ring.OwnersAmong(key, d.candidates(NewNodeID(key), nil), n)
 }
 
-func (d *DHT) Put(key, value string, version int64) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+// the tokens of this node and its contacts in ring order
+func (d *DHT) RingPoints() []RingPoint {
+	return d.ring.Points()
+}
 
-	d.data[key] = DataEntry{
-		Value:     string(value),
-		Version:   version,
-		Timestamp: time.Now(),
-	}
+func (d *DHT) ListNodes() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return append([]string{}, d.nodes...)
 }
 
-func (d *DHT) Store(key string, value []byte) error {
+// deletes key cluster-wide, returning once one replica holds the tombstone.
+// The other owners receive it in the background.
+func (d *DHT) Remove(key string) error {
+	return d.Delete(context.Background(), key, WriteOpts{W: 1})
+}
+
+// sets key on this node only, superseding every version held here, without
+// replicating
+func (d *DHT) PutLocal(key, value string) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	d.data[key] = DataEntry{
-		Value:     string(value),
-		Version:   1,
-		Timestamp: time.Now(),
+	existing, ok, err := d.store.Get(key)
+	if err != nil {
+		return err
 	}
-
+	entry := d.newEntry(value, existing.Context())
+	if err := d.store.Put(key, entry); err != nil {
+		return err
+	}
+	d.changed(key, existing, ok, entry, true)
 	return nil
 }
 
-func (d *DHT) Get(key string) (string, error) {
-	d.lock.RLock()
-	defer d.lock.RUnlock()
+func (d *DHT) Store(key string, value []byte) error {
+	return d.PutLocal(key, string(value))
+}
 
-	entry, exists := d.data[key]
+// key's value from this node's own data only, without asking any replica
+func (d *DHT) GetLocal(key string) (string, error) {
+	entry, exists := d.getLocal(key)
+	if exists {
+		entry, exists = visibleEntry(entry)
+	}
 	if !exists {
-		return "", errors.New("key not found")
+		return "", ErrNotFound
 	}
-
 	return entry.Value, nil
 }
 
-func (d *DHT) Replicate(key, value string) error {
-	for _, node := range d.nodes {
-		err := d.sendToNode(node, key, value)
-		if err != nil {
-			return err
-		}
+// our copy of key including tombstones, which other replicas must see
+func (d *DHT) getLocal(key string) (DataEntry, bool) {
+	entry, exists, err := d.store.Get(key)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", key, err)
+		return DataEntry{}, false
 	}
-	return nil
+	if !exists {
+		return DataEntry{}, false
+	}
+	return liveEntry(entry, time.Now())
 }
 
-func (d *DHT) PutConsistent(key, value string, replicationFactor int) error {
+// merges entry into our copy of key, so late or duplicated replication can't
+// roll a key back and concurrent writes end up as siblings
+func (d *DHT) apply(key string, entry DataEntry) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	return d.applyLocked(key, entry)
+}
 
-	// Store data locally
-	d.data[key] = DataEntry{
-		Value:     value,
-		Version:   1,
-		Timestamp: time.Now(),
+// like apply, callers hold d.lock
+func (d *DHT) applyLocked(key string, entry DataEntry) error {
+	existing, ok, err := d.store.Get(key)
+	if err != nil {
+		return err
 	}
-
-	if len(d.nodes) == 0 {
-		return errors.New("no available nodes to replicate")
+	if ok {
+		entry = mergeEntries(existing, entry)
+	}
+	entry, live := liveEntry(entry, time.Now())
+	if !live {
+		// an expired write replicated late, nothing of the key is left
+		if !ok {
+			return nil
+		}
+		if err := d.store.Delete(key); err != nil {
+			return err
+		}
+		d.changed(key, existing, true, DataEntry{}, false)
+		return nil
 	}
+	if err := d.store.Put(key, entry); err != nil {
+		return err
+	}
+	d.changed(key, existing, ok, entry, true)
+	return nil
+}
 
-	// Replicate to available nodes
-	for i := 0; i < replicationFactor && i < len(d.nodes); i++ {
-		node := d.nodes[i%len(d.nodes)]
-		err := d.sendToNode(node, key, value)
+func (d *DHT) Replicate(key, value string) error {
+	entry := d.newEntry(value, nil)
+	for _, node := range d.ListNodes() {
+		err := d.sendToNode(context.Background(), node, key, entry)
 		if err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func (d *DHT) sendToNode(node, key, value string) error {
-	payload := map[string]string{
-		"key":   key,
-		"value": value,
-	}
+// stores key on all replicationFactor nodes that own it on the ring, failing
+// unless every one of them acknowledges the write. Hints held for owners that
+// can't be reached don't count.
+func (d *DHT) PutConsistent(key, value string, replicationFactor int) error {
+	return d.Put(context.Background(), key, value, WriteOpts{N: replicationFactor, W: replicationFactor})
+}
 
-	data, err := json.Marshal(payload)
+type storeRequest struct {
+	Key   string    `json:"key"`
+	Entry DataEntry `json:"entry"`
+}
+
+func (d *DHT) sendToNode(ctx context.Context, node, key string, entry DataEntry) error {
+	data, err := json.Marshal(storeRequest{Key: key, Entry: entry})
 	if err != nil {
 		return err
 	}
 
 	msg := p2p.Message{
-		Type:    "dht_store",
+		Type:    msgStore,
 		Payload: data,
 	}
 
@@ -172,21 +458,26 @@ func (d *DHT) sendToNode(node, key, value string) error {
 			lastErr = err
 			continue
 		}
-		defer peer.Close()
 
-		// Send data
-		err = peer.Send(msg)
-		if err != nil {
+		reqCtx, cancel := context.WithTimeout(ctx, d.requestTimeout)
+		resp, err := peer.Request(reqCtx, msg)
+		cancel()
+		// hands the connection back to the transport's pool
+		peer.Close()
+
+		if errors.Is(err, p2p.ErrRemote) {
 			return err
 		}
-
-		// Read acknowledgment
-		resp, err := peer.Receive()
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// a pooled connection may have gone stale, try a fresh one
+			lastErr = err
+			continue
 		}
 
-		if resp.Type != "ack" {
+		if resp.Type != msgAck {
 			return errors.New("unexpected response from node")
 		}
 
@@ -195,6 +486,107 @@ func (d *DHT) sendToNode(node, key, value string) error {
 	return fmt.Errorf("failed after %d retries: %v", maxRetries, lastErr)
 }
 
+// stores a key replicated to us by another node
+func (d *DHT) handleStore(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req storeRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode store payload: %v", err)
+	}
+	if req.Key == "" {
+		return p2p.Message{}, errors.New("store payload missing key")
+	}
+
+	if err := d.apply(req.Key, req.Entry); err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.Message{Type: msgAck}, nil
+}
+
+// sends body as msgType to node and decodes a reply of type replyType into out
+func (d *DHT) request(ctx context.Context, node, msgType string, body interface{}, replyType string, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	peer, err := d.transport.Dial(node)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, d.requestTimeout)
+	defer cancel()
+	resp, err := peer.Request(ctx, p2p.Message{Type: msgType, Payload: data})
+	if err != nil {
+		return err
+	}
+	if resp.Type != replyType {
+		return errors.New("unexpected response from node")
+	}
+	if err := json.Unmarshal(resp.Payload, out); err != nil {
+		return fmt.Errorf("decode %s: %v", replyType, err)
+	}
+	return nil
+}
+
+// sends body as msgType to node and waits for its ack
+func (d *DHT) send(ctx context.Context, node, msgType string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	peer, err := d.transport.Dial(node)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, d.requestTimeout)
+	defer cancel()
+	resp, err := peer.Request(ctx, p2p.Message{Type: msgType, Payload: data})
+	if err != nil {
+		return err
+	}
+	if resp.Type != msgAck {
+		return errors.New("unexpected response from node")
+	}
+	return nil
+}
+
+type getResponse struct {
+	Entry DataEntry `json:"entry"`
+	Found bool      `json:"found"`
+}
+
+// asks node for its copy of key
+func (d *DHT) fetchFromNode(ctx context.Context, node, key string) (DataEntry, bool, error) {
+	var out getResponse
+	err := d.request(ctx, node, msgGet, map[string]string{"key": key}, msgEntry, &out)
+	return out.Entry, out.Found, err
+}
+
+// returns our copy of a key to another node
+func (d *DHT) handleGet(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var payload map[string]string
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode get payload: %v", err)
+	}
+
+	key, ok := payload["key"]
+	if !ok {
+		return p2p.Message{}, errors.New("get payload missing key")
+	}
+
+	entry, found := d.getLocal(key)
+	data, err := json.Marshal(getResponse{Entry: entry, Found: found})
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.Message{Type: msgEntry, Payload: data}, nil
+}
+
 func Hash(key string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(key))
@@ -0,0 +1,138 @@
+package node
+
+import (
+	"log"
+	"time"
+)
+
+// how often expired entries are removed from the store by default
+const DefaultReapInterval = time.Minute
+
+// sets how often this node removes expired entries from its store. Expired
+// entries are never returned whether or not they've been reaped yet.
+func WithReapInterval(interval time.Duration) Option {
+	return func(d *DHT) {
+		d.reapInterval = interval
+	}
+}
+
+// whether this version's TTL has run out by now
+func (e DataEntry) expiredAt(now time.Time) bool {
+	return expiredAt(e.ExpiresAt, now)
+}
+
+// whether a version expiring at expiresAt has by now, zero never expires
+func expiredAt(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// e without the versions that have expired by now, false if none are left.
+// Every replica holds the same ExpiresAt for a write, so they all agree on
+// what is live up to the skew between their clocks.
+func liveEntry(e DataEntry, now time.Time) (DataEntry, bool) {
+	return filterVersions(e, func(v DataEntry) bool {
+		return !v.expiredAt(now)
+	})
+}
+
+// e with only the versions keep accepts, the first of them as the primary
+func filterVersions(e DataEntry, keep func(DataEntry) bool) (DataEntry, bool) {
+	if len(e.Siblings) == 0 {
+		return e, keep(e)
+	}
+
+	var kept []DataEntry
+	for _, v := range e.Versions() {
+		if keep(v) {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		return DataEntry{}, false
+	}
+	if len(kept) == len(e.Siblings)+1 {
+		return e, true
+	}
+	out := kept[0]
+	if len(kept) > 1 {
+		out.Siblings = kept[1:]
+	}
+	return out, true
+}
+
+// removes every expired entry and tombstone past its grace period from the
+// store and drops expired siblings
+func (d *DHT) reap() {
+	now := time.Now()
+	var stale []string
+	err := d.store.Iterate("", func(key string, entry DataEntry) bool {
+		if live, ok := liveEntry(entry, now); !ok || len(live.Siblings) != len(entry.Siblings) {
+			stale = append(stale, key)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Failed to read data: %v", err)
+		return
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var b Batch
+	type change struct {
+		key           string
+		before, after DataEntry
+		live          bool
+	}
+	var changes []change
+	removed, collected := 0, 0
+	for _, key := range stale {
+		// a write may have landed since the scan
+		entry, ok, err := d.store.Get(key)
+		if err != nil || !ok {
+			continue
+		}
+		live, ok := liveEntry(entry, now)
+		changes = append(changes, change{key, entry, live, ok})
+		if !ok {
+			b.Delete(key)
+			if _, visible := visibleEntry(entry); visible {
+				removed++
+			} else {
+				collected++
+			}
+		} else if len(live.Siblings) != len(entry.Siblings) {
+			b.Put(key, live)
+		}
+	}
+	if err := d.store.Batch(&b); err != nil {
+		log.Printf("Failed to remove expired entries: %v", err)
+		return
+	}
+	for _, c := range changes {
+		d.changed(c.key, c.before, true, c.after, c.live)
+	}
+	d.metrics.expired.Add(int64(removed))
+	d.metrics.tombstonesCollected.Add(int64(collected))
+	if removed > 0 || collected > 0 {
+		log.Printf("Removed %d expired entries and %d tombstones", removed, collected)
+	}
+}
+
+func (d *DHT) reapLoop() {
+	ticker := time.NewTicker(d.reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.reap()
+		}
+	}
+}
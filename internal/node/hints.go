@@ -0,0 +1,119 @@
+package node
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+// how often pending hints are retried when no reconnect is seen
+const DefaultHintReplayInterval = 10 * time.Second
+
+// keeps writes a replica couldn't take as hints on this node, they are
+// replayed once the replica is back. Replay is attempted whenever a connection
+// to the replica comes up and every interval. Hints live in memory only, so
+// they never count towards W: a write whose other copies are all hints would
+// be lost with this node.
+func WithHintedHandoff(interval time.Duration) Option {
+	return func(d *DHT) {
+		d.hintedHandoff = true
+		d.hintInterval = interval
+	}
+}
+
+// records entry as owed to owner
+func (d *DHT) addHint(owner, key string, entry DataEntry) {
+	d.hintsLock.Lock()
+	defer d.hintsLock.Unlock()
+
+	if d.hints == nil {
+		d.hints = make(map[string]map[string]DataEntry)
+	}
+	owed := d.hints[owner]
+	if owed == nil {
+		owed = make(map[string]DataEntry)
+		d.hints[owner] = owed
+	}
+	if existing, ok := owed[key]; ok {
+		entry = mergeEntries(existing, entry)
+	}
+	owed[key] = entry
+}
+
+// number of hinted writes held for each unavailable replica
+func (d *DHT) PendingHints() map[string]int {
+	d.hintsLock.Lock()
+	defer d.hintsLock.Unlock()
+
+	counts := make(map[string]int)
+	for owner, owed := range d.hints {
+		counts[owner] = len(owed)
+	}
+	return counts
+}
+
+// sends owner every write it missed, stopping at the first failure so an
+// owner that is still down costs a single attempt
+func (d *DHT) replayHints(owner string) {
+	d.hintsLock.Lock()
+	owed := make(map[string]DataEntry, len(d.hints[owner]))
+	for key, entry := range d.hints[owner] {
+		owed[key] = entry
+	}
+	d.hintsLock.Unlock()
+
+	replayed := 0
+	defer func() {
+		if replayed > 0 {
+			log.Printf("Replayed %d hinted writes to %s", replayed, owner)
+		}
+	}()
+
+	for key, entry := range owed {
+		if err := d.sendToNode(context.Background(), owner, key, entry); err != nil {
+			return
+		}
+		replayed++
+
+		d.hintsLock.Lock()
+		// a newer hint may have arrived while this one was in flight
+		if current, ok := d.hints[owner][key]; ok && current.Context().Compare(entry.Context()) == Equal {
+			delete(d.hints[owner], key)
+			if len(d.hints[owner]) == 0 {
+				delete(d.hints, owner)
+			}
+		}
+		d.hintsLock.Unlock()
+	}
+}
+
+// replays hints to an owner as soon as a connection to it comes up
+func (d *DHT) onPeerConnected(peer p2p.Peer) {
+	owner := peer.RemoteAddr()
+	if d.PendingHints()[owner] > 0 {
+		go d.replayHints(owner)
+	}
+}
+
+// retries every owner with pending hints each interval until the DHT closes
+func (d *DHT) replayLoop() {
+	interval := d.hintInterval
+	if interval <= 0 {
+		interval = DefaultHintReplayInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+		for owner := range d.PendingHints() {
+			d.replayHints(owner)
+		}
+	}
+}
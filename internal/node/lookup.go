@@ -0,0 +1,303 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+const (
+	msgFindNode  = "dht_find_node"
+	msgFindValue = "dht_find_value"
+	msgNodes     = "dht_nodes"
+
+	// lookups query this many contacts at once
+	LookupConcurrency = 3
+)
+
+var (
+	ErrInvalidNodeID = errors.New("invalid node id")
+	ErrNoContacts    = errors.New("no contacts to query")
+)
+
+type findRequest struct {
+	Target string `json:"target"`
+	Key    string `json:"key,omitempty"`
+}
+
+type findResponse struct {
+	Nodes []string `json:"nodes"`
+	Value string   `json:"value,omitempty"`
+	Found bool     `json:"found,omitempty"`
+}
+
+// joins the cluster through seeds. Looking up our own ID fills the routing
+// table with our neighbours, and every node asked on the way learns of us.
+// No node needs to know every member, see FindOwners.
+func (d *DHT) Bootstrap(ctx context.Context, seeds ...string) error {
+	for _, seed := range seeds {
+		d.AddNode(seed)
+	}
+	if _, err := d.FindNode(ctx, d.routing.Self().ID); err != nil {
+		return fmt.Errorf("bootstrap: %v", err)
+	}
+	return nil
+}
+
+// the BucketSize nodes closest to target that answered, found by iteratively
+// asking the closest known nodes for nodes closer still
+func (d *DHT) FindNode(ctx context.Context, target NodeID) ([]string, error) {
+	closest, _, err := d.lookup(ctx, msgFindNode, findRequest{Target: target.String()})
+	return closest, err
+}
+
+// key's value from this node or, failing that, from the first node holding it
+// that a FIND_VALUE lookup reaches. Its owners are among the nodes closest
+// to the key, so the lookup gets to them in O(log n) hops.
+func (d *DHT) FindValue(ctx context.Context, key string) (string, error) {
+	if value, err := d.GetLocal(key); err == nil {
+		return value, nil
+	}
+
+	_, resp, err := d.lookup(ctx, msgFindValue, findRequest{Target: NewNodeID(key).String(), Key: key})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return "", ctxErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	if !resp.Found {
+		return "", ErrNotFound
+	}
+	return resp.Value, nil
+}
+
+// the n owners of key, found by looking up the nodes closest to it so that
+// nodes knowing different parts of the cluster agree on them. Contacts of
+// ours that didn't answer stay candidates, a write still has to reach them
+// later. See OwnersOf.
+func (d *DHT) FindOwners(ctx context.Context, key string, n int) ([]string, error) {
+	target := NewNodeID(key)
+	found, _, _ := d.lookup(ctx, msgFindNode, findRequest{Target: target.String()})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// when no contact answers, as when we are alone or cut off, the key is
+	// placed with our own contacts
+	return d.ring.OwnersAmong(key, d.candidates(target, found), n), nil
+}
+
+// the BucketSize nodes closest to target among this node, its contacts and
+// extra, the nodes a key with that ID is placed on
+func (d *DHT) candidates(target NodeID, extra []string) []string {
+	contacts := append(d.routing.Closest(target, BucketSize), NewContact(d.selfNode))
+	seen := make(map[string]bool, len(contacts))
+	for _, c := range contacts {
+		seen[c.Addr] = true
+	}
+	for _, addr := range extra {
+		if !seen[addr] {
+			seen[addr] = true
+			contacts = append(contacts, NewContact(addr))
+		}
+	}
+	sortByDistance(contacts, target)
+	if len(contacts) > BucketSize {
+		contacts = contacts[:BucketSize]
+	}
+
+	addrs := make([]string, len(contacts))
+	for i, c := range contacts {
+		addrs[i] = c.Addr
+	}
+	return addrs
+}
+
+type lookupResult struct {
+	addr string
+	resp findResponse
+	err  error
+}
+
+// runs a Kademlia lookup for req.Target, msgType picks FIND_NODE or
+// FIND_VALUE. Stops once the closest BucketSize nodes seen have all been
+// queried, or as soon as one of them returns the value.
+func (d *DHT) lookup(ctx context.Context, msgType string, req findRequest) ([]string, findResponse, error) {
+	target, err := ParseNodeID(req.Target)
+	if err != nil {
+		return nil, findResponse{}, err
+	}
+	shortlist := d.routing.Closest(target, BucketSize)
+	if len(shortlist) == 0 {
+		return nil, findResponse{}, ErrNoContacts
+	}
+
+	seen := map[string]bool{d.selfNode: true}
+	for _, c := range shortlist {
+		seen[c.Addr] = true
+	}
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+
+	for {
+		var batch []string
+		for _, c := range shortlist {
+			if len(batch) == LookupConcurrency {
+				break
+			}
+			if !queried[c.Addr] {
+				batch = append(batch, c.Addr)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, addr := range batch {
+			queried[addr] = true
+			go func(addr string) {
+				resp, err := d.call(ctx, addr, msgType, req)
+				results <- lookupResult{addr: addr, resp: resp, err: err}
+			}(addr)
+		}
+
+		var value *findResponse
+		for range batch {
+			r := <-results
+			if r.err != nil {
+				failed[r.addr] = true
+				continue
+			}
+			// it answered, so it is a live node at that address
+			d.AddNode(r.addr)
+			if r.resp.Found && value == nil {
+				value = &r.resp
+			}
+			for _, addr := range r.resp.Nodes {
+				if !seen[addr] {
+					seen[addr] = true
+					shortlist = append(shortlist, NewContact(addr))
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, findResponse{}, err
+		}
+		if value != nil {
+			return nil, *value, nil
+		}
+
+		kept := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.Addr] {
+				kept = append(kept, c)
+			}
+		}
+		shortlist = kept
+		sortByDistance(shortlist, target)
+		if len(shortlist) > BucketSize {
+			shortlist = shortlist[:BucketSize]
+		}
+	}
+
+	if len(shortlist) == 0 {
+		return nil, findResponse{}, errors.New("no contacts answered")
+	}
+	closest := make([]string, len(shortlist))
+	for i, c := range shortlist {
+		closest[i] = c.Addr
+	}
+	return closest, findResponse{}, nil
+}
+
+// sends a single find request to node, msgType picks FIND_NODE or FIND_VALUE
+func (d *DHT) call(ctx context.Context, node, msgType string, req findRequest) (findResponse, error) {
+	var out findResponse
+	err := d.request(ctx, node, msgType, req, msgNodes, &out)
+	return out, err
+}
+
+// answers FIND_NODE with our contacts closest to the target, and FIND_VALUE
+// with the value instead when we hold it
+func (d *DHT) handleFind(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req findRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode find payload: %v", err)
+	}
+	target, err := ParseNodeID(req.Target)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	if msg.Sender != "" {
+		d.heardFrom(msg.Sender)
+	}
+
+	var resp findResponse
+	if msg.Type == msgFindValue {
+		if value, err := d.GetLocal(req.Key); err == nil {
+			resp.Value, resp.Found = value, true
+		}
+	}
+	if !resp.Found {
+		for _, c := range d.routing.Closest(target, BucketSize) {
+			if c.Addr != msg.Sender {
+				resp.Nodes = append(resp.Nodes, c.Addr)
+			}
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.Message{Type: msgNodes, Payload: data}, nil
+}
+
+// records sender, who asked us something, as a contact. Senders name
+// themselves, so one we don't know yet is added only once it answers a ping
+// at that address.
+func (d *DHT) heardFrom(sender string) {
+	if d.isMember(sender) {
+		d.routing.Update(sender)
+		return
+	}
+	go func() {
+		if err := d.ping(sender); err == nil {
+			d.AddNode(sender)
+		}
+	}()
+}
+
+// pings the least recently seen contact of a full bucket and replaces it with
+// addr only if it doesn't answer
+func (d *DHT) challenge(oldest Contact, addr string) {
+	err := d.ping(oldest.Addr)
+	if err == nil {
+		// still alive, refresh it and drop the newcomer
+		d.routing.Update(oldest.Addr)
+		return
+	}
+
+	log.Printf("Replacing unresponsive contact %s with %s: %v", oldest.Addr, addr, err)
+	d.routing.Remove(oldest.Addr)
+	d.removeMember(oldest.Addr)
+	d.AddNode(addr)
+}
+
+func (d *DHT) ping(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.requestTimeout)
+	defer cancel()
+
+	peer, err := d.transport.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+	_, err = peer.Request(ctx, p2p.Message{Type: p2p.MessageTypePing})
+	return err
+}
@@ -0,0 +1,307 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// levels below the root, the tree has 1<<MerkleDepth leaves
+const MerkleDepth = 8
+
+// a hash tree over a set of entries. Keys are spread over the leaves by their
+// ring hash so two replicas holding the same keys put them in the same leaf,
+// and a differing leaf narrows a repair down to 1/256th of the keys.
+type MerkleTree struct {
+	// heap layout, node i has children 2i+1 and 2i+2, leaves come last
+	nodes [][sha256.Size]byte
+}
+
+func merkleLeaves() int {
+	return 1 << MerkleDepth
+}
+
+// index of the leaf key falls into
+func merkleLeaf(key string) int {
+	return int(ringHash(key) >> (32 - MerkleDepth))
+}
+
+func newEmptyMerkleTree() *MerkleTree {
+	t := &MerkleTree{nodes: make([][sha256.Size]byte, 2*merkleLeaves()-1)}
+	for i := merkleLeaves() - 2; i >= 0; i-- {
+		t.nodes[i] = t.parentHash(i)
+	}
+	return t
+}
+
+// the hash of a leaf holding keys, whose entries have digests. An empty leaf
+// hashes to zero.
+func leafHash(keys []string, digests [][sha256.Size]byte) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	if len(keys) == 0 {
+		return sum
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return keys[order[a]] < keys[order[b]]
+	})
+	h := sha256.New()
+	for _, i := range order {
+		h.Write(digests[i][:])
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func (t *MerkleTree) parentHash(i int) [sha256.Size]byte {
+	return sha256.Sum256(append(t.nodes[2*i+1][:], t.nodes[2*i+2][:]...))
+}
+
+// replaces leaf i and rehashes its path up to the root
+func (t *MerkleTree) setLeaf(i int, h [sha256.Size]byte) {
+	n := merkleLeaves() - 1 + i
+	if t.nodes[n] == h {
+		return
+	}
+	t.nodes[n] = h
+	for n > 0 {
+		n = (n - 1) / 2
+		t.nodes[n] = t.parentHash(n)
+	}
+}
+
+func (t *MerkleTree) clone() *MerkleTree {
+	return &MerkleTree{nodes: append([][sha256.Size]byte(nil), t.nodes...)}
+}
+
+func (t *MerkleTree) Root() []byte {
+	return t.nodes[0][:]
+}
+
+// the hash of every leaf in order
+func (t *MerkleTree) Leaves() [][]byte {
+	first := merkleLeaves() - 1
+	out := make([][]byte, merkleLeaves())
+	for i := range out {
+		out[i] = t.nodes[first+i][:]
+	}
+	return out
+}
+
+// leaves whose hash differs from the matching one in leaves
+func (t *MerkleTree) Diff(leaves [][]byte) []int {
+	var diff []int
+	for i, h := range t.Leaves() {
+		if i >= len(leaves) || string(h) != string(leaves[i]) {
+			diff = append(diff, i)
+		}
+	}
+	return diff
+}
+
+// the digest of every key this node holds, grouped by leaf and kept up to
+// date as entries change, so anti-entropy never has to scan the store. Each
+// peer shares a different subset of the keys, so a tree is cached per peer
+// and a change only marks its leaf for rehashing.
+type merkleIndex struct {
+	lock   sync.Mutex
+	leaves []map[string]indexedEntry
+	trees  map[string]*peerTree
+}
+
+// an entry's versions, only live ones count towards its leaf
+type indexedEntry []indexedVersion
+
+type indexedVersion struct {
+	digest    [sha256.Size]byte
+	expiresAt time.Time
+}
+
+type peerTree struct {
+	tree  *MerkleTree
+	dirty []bool
+	// when each leaf's next version expires, zero if none does, the leaf has
+	// to be rehashed from then on
+	expires []time.Time
+}
+
+func newMerkleIndex() *merkleIndex {
+	x := &merkleIndex{
+		leaves: make([]map[string]indexedEntry, merkleLeaves()),
+		trees:  make(map[string]*peerTree),
+	}
+	for i := range x.leaves {
+		x.leaves[i] = make(map[string]indexedEntry)
+	}
+	return x
+}
+
+// records our copy of key, or its removal when present is false
+func (x *merkleIndex) update(key string, entry DataEntry, present bool) {
+	i := merkleLeaf(key)
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if present {
+		versions := make(indexedEntry, 0, len(entry.Siblings)+1)
+		for _, v := range entry.Versions() {
+			versions = append(versions, indexedVersion{digest: versionDigest(v), expiresAt: v.ExpiresAt})
+		}
+		x.leaves[i][key] = versions
+	} else {
+		delete(x.leaves[i], key)
+	}
+	for _, t := range x.trees {
+		t.dirty[i] = true
+	}
+}
+
+// drops every cached tree, the keys shared with each peer change along with
+// the ring
+func (x *merkleIndex) invalidate() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.trees = make(map[string]*peerTree)
+}
+
+// the tree over the live keys shared reports as held by peer as well,
+// rehashing only the leaves that changed, or where a version expired, since
+// it was last asked for
+func (x *merkleIndex) tree(peer string, shared func(key string) bool) *MerkleTree {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	t, ok := x.trees[peer]
+	if !ok {
+		t = &peerTree{
+			tree:    newEmptyMerkleTree(),
+			dirty:   make([]bool, merkleLeaves()),
+			expires: make([]time.Time, merkleLeaves()),
+		}
+		for i := range t.dirty {
+			t.dirty[i] = true
+		}
+		x.trees[peer] = t
+	}
+	now := time.Now()
+	for i, dirty := range t.dirty {
+		if !dirty && !expiredAt(t.expires[i], now) {
+			continue
+		}
+		var keys []string
+		var digests [][sha256.Size]byte
+		var next time.Time
+		for key, e := range x.leaves[i] {
+			if !shared(key) {
+				continue
+			}
+			if digest, ok := e.digestAt(key, now); ok {
+				keys = append(keys, key)
+				digests = append(digests, digest)
+			}
+			if at := e.nextExpiry(now); !at.IsZero() && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+		t.tree.setLeaf(i, leafHash(keys, digests))
+		t.dirty[i] = false
+		t.expires[i] = next
+	}
+	return t.tree.clone()
+}
+
+// the keys in leaves that shared accepts
+func (x *merkleIndex) keys(leaves []int, shared func(key string) bool) []string {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	var keys []string
+	for _, i := range leaves {
+		if i < 0 || i >= len(x.leaves) {
+			continue
+		}
+		for key := range x.leaves[i] {
+			if shared(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// the digest of the versions of key live at now, as entryDigest would give
+// for liveEntry, false when none are
+func (e indexedEntry) digestAt(key string, now time.Time) ([sha256.Size]byte, bool) {
+	var versions [][sha256.Size]byte
+	for _, v := range e {
+		if !expiredAt(v.expiresAt, now) {
+			versions = append(versions, v.digest)
+		}
+	}
+	if len(versions) == 0 {
+		return [sha256.Size]byte{}, false
+	}
+	return combineDigests(key, versions), true
+}
+
+// when the next of e's live versions expires, zero if none of them does
+func (e indexedEntry) nextExpiry(now time.Time) time.Time {
+	var next time.Time
+	for _, v := range e {
+		if v.expiresAt.IsZero() || expiredAt(v.expiresAt, now) {
+			continue
+		}
+		if next.IsZero() || v.expiresAt.Before(next) {
+			next = v.expiresAt
+		}
+	}
+	return next
+}
+
+// identifies every version of an entry, independent of the order siblings
+// were merged in
+func entryDigest(key string, e DataEntry) [sha256.Size]byte {
+	versions := make([][sha256.Size]byte, 0, len(e.Siblings)+1)
+	for _, v := range e.Versions() {
+		versions = append(versions, versionDigest(v))
+	}
+	return combineDigests(key, versions)
+}
+
+// identifies a single version by its value and clock
+func versionDigest(v DataEntry) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(v.Value))
+	nodes := make([]string, 0, len(v.Clock))
+	for node := range v.Clock {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		h.Write([]byte(node))
+		binary.Write(h, binary.BigEndian, v.Clock[node])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func combineDigests(key string, versions [][sha256.Size]byte) [sha256.Size]byte {
+	sort.Slice(versions, func(i, j int) bool {
+		return string(versions[i][:]) < string(versions[j][:])
+	})
+
+	h := sha256.New()
+	h.Write([]byte(key))
+	for _, v := range versions {
+		h.Write(v[:])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
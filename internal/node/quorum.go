@@ -0,0 +1,243 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+var ErrQuorum = errors.New("quorum not reached")
+
+// how widely a write is replicated and how many replicas must acknowledge it
+// before Put returns. Zero values fall back to the node's replication factor
+// and a majority of N.
+type WriteOpts struct {
+	N int
+	W int
+	// the Context of the entry this write replaces, as read with GetVersions.
+	// Without it a put supersedes only what this node has seen, and a delete
+	// reads the owners' versions first and supersedes those.
+	Context VectorClock
+	// how long the value lives, after which every replica treats the key as
+	// missing and removes it. Zero keeps it until it is overwritten.
+	TTL time.Duration
+}
+
+// how many replicas are asked for a key and how many must answer before Get
+// returns. Zero values fall back to the node's replication factor and a
+// majority of N. R + W > N gives reads that see the latest acknowledged write.
+type ReadOpts struct {
+	N int
+	R int
+}
+
+// fills in defaults and caps the quorum at the replica count
+func (d *DHT) quorum(n, q int) (int, int) {
+	if n <= 0 {
+		n = d.replicationFactor
+	}
+	if q <= 0 {
+		q = n/2 + 1
+	}
+	if q > n {
+		q = n
+	}
+	return n, q
+}
+
+// a new version of value that descends from causal
+func (d *DHT) newEntry(value string, causal VectorClock) DataEntry {
+	// our counter in causal may be ahead of the local clock, after a restart
+	// with the clock set back, and the new entry must still descend from it
+	tick := d.clock.tick(causal[d.selfNode])
+	clock := causal.Copy()
+	clock[d.selfNode] = tick
+	return DataEntry{Value: value, Version: int64(tick), Timestamp: time.Now(), Clock: clock}
+}
+
+// writes key to the N replicas that own it and returns once W of them have
+// acknowledged. Replicas that haven't answered yet keep receiving the write
+// in the background. With hinted handoff a replica that can't be reached gets
+// the write later from a hint held here, but that doesn't count towards W.
+func (d *DHT) Put(ctx context.Context, key, value string, opts WriteOpts) error {
+	return d.write(ctx, key, value, false, opts)
+}
+
+// replicates a new version of key, a tombstone when deleted is set
+func (d *DHT) write(ctx context.Context, key, value string, deleted bool, opts WriteOpts) error {
+	n, w := d.quorum(opts.N, opts.W)
+	owners, err := d.FindOwners(ctx, key, n)
+	if err != nil {
+		return err
+	}
+	if len(owners) < w {
+		return fmt.Errorf("%w: %d replicas known, %d acks required", ErrQuorum, len(owners), w)
+	}
+	causal := opts.Context
+	if causal == nil && deleted {
+		// a tombstone must descend from what the owners hold, this node may
+		// not hold a copy at all
+		_, r := d.quorum(n, 0)
+		if r > len(owners) {
+			r = len(owners)
+		}
+		current, err := d.GetVersions(ctx, key, ReadOpts{N: n, R: r})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		causal = current.Context()
+	}
+	if causal == nil {
+		local, _ := d.getLocal(key)
+		causal = local.Context()
+	}
+	entry := d.newEntry(value, causal)
+	if deleted {
+		// every replica collects the tombstone once its grace period is over
+		entry.Deleted = true
+		entry.ExpiresAt = entry.Timestamp.Add(d.tombstoneGrace)
+	} else if opts.TTL > 0 {
+		entry.ExpiresAt = entry.Timestamp.Add(opts.TTL)
+	}
+
+	results := make(chan error, len(owners))
+	for _, node := range owners {
+		if node == d.selfNode {
+			if err := d.apply(key, entry); err != nil {
+				results <- fmt.Errorf("%s: %v", node, err)
+			} else {
+				results <- nil
+			}
+			continue
+		}
+		go func(node string) {
+			err := d.sendToNode(context.Background(), node, key, entry)
+			if err != nil && d.hintedHandoff && !errors.Is(err, p2p.ErrRemote) {
+				log.Printf("Holding hinted write of %s for %s: %v", key, node, err)
+				d.addHint(node, key, entry)
+			}
+			if err != nil {
+				results <- fmt.Errorf("%s: %v", node, err)
+				return
+			}
+			results <- nil
+		}(node)
+	}
+
+	acks := 0
+	var errs []error
+	for range owners {
+		select {
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				acks++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if acks >= w {
+			return nil
+		}
+		if len(owners)-len(errs) < w {
+			break
+		}
+	}
+	return fmt.Errorf("%w: %d of %d acks: %v", ErrQuorum, acks, w, errors.Join(errs...))
+}
+
+// key's newest value among the first R of its N replicas to answer, falling
+// back to a copy held here when none of them has it. Concurrent versions are
+// settled by the Resolver if there is one, otherwise the latest write wins.
+func (d *DHT) Get(ctx context.Context, key string, opts ReadOpts) (string, error) {
+	entry, err := d.GetVersions(ctx, key, opts)
+	if err != nil {
+		return "", err
+	}
+	if len(entry.Siblings) > 0 && d.resolver != nil {
+		return d.resolver(key, entry.Versions()), nil
+	}
+	return entry.Value, nil
+}
+
+// like Get but returns every concurrent version of key, its Context is what a
+// write settling them must pass in WriteOpts
+func (d *DHT) GetVersions(ctx context.Context, key string, opts ReadOpts) (DataEntry, error) {
+	n, r := d.quorum(opts.N, opts.R)
+	owners, err := d.FindOwners(ctx, key, n)
+	if err != nil {
+		return DataEntry{}, err
+	}
+	if len(owners) < r {
+		return DataEntry{}, fmt.Errorf("%w: %d replicas known, %d replies required", ErrQuorum, len(owners), r)
+	}
+
+	results := make(chan replicaReply, len(owners))
+	for _, node := range owners {
+		if node == d.selfNode {
+			entry, found := d.getLocal(key)
+			results <- replicaReply{node: node, entry: entry, found: found}
+			continue
+		}
+		go func(node string) {
+			entry, found, err := d.fetchFromNode(ctx, node, key)
+			if err != nil {
+				err = fmt.Errorf("%s: %v", node, err)
+			}
+			results <- replicaReply{node: node, entry: entry, found: found, err: err}
+		}(node)
+	}
+
+	var merged DataEntry
+	found := false
+	var replies []replicaReply
+	var errs []error
+	for range owners {
+		var res replicaReply
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return DataEntry{}, ctx.Err()
+		}
+
+		if res.err != nil {
+			errs = append(errs, res.err)
+		} else {
+			replies = append(replies, res)
+			if res.found && found {
+				merged = mergeEntries(merged, res.entry)
+			} else if res.found {
+				merged, found = res.entry, true
+			}
+		}
+		if len(replies) >= r || len(owners)-len(errs) < r {
+			break
+		}
+	}
+	d.metrics.reads.Add(1)
+	if len(replies) < r {
+		return DataEntry{}, fmt.Errorf("%w: %d of %d replies: %v", ErrQuorum, len(replies), r, errors.Join(errs...))
+	}
+	if found {
+		remaining := len(owners) - len(replies) - len(errs)
+		go d.readRepair(key, merged, replies, results, remaining)
+		// a tombstone is repaired like any write but reads as missing
+		if merged, ok := visibleEntry(merged); ok {
+			return merged, nil
+		}
+		return DataEntry{}, ErrNotFound
+	}
+
+	if entry, ok := d.getLocal(key); ok {
+		if entry, ok := visibleEntry(entry); ok {
+			return entry, nil
+		}
+	}
+	return DataEntry{}, ErrNotFound
+}
@@ -0,0 +1,94 @@
+package node
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+)
+
+// one replica's answer to a read
+type replicaReply struct {
+	node  string
+	entry DataEntry
+	found bool
+	err   error
+}
+
+// counters kept by a DHT since it started
+type metrics struct {
+	reads               atomic.Int64
+	readRepairs         atomic.Int64
+	readRepairWrites    atomic.Int64
+	readRepairFailures  atomic.Int64
+	expired             atomic.Int64
+	tombstonesCollected atomic.Int64
+}
+
+// a point in time copy of a DHT's counters
+type Metrics struct {
+	// quorum reads served
+	Reads int64 `json:"reads"`
+	// reads that found at least one stale replica
+	ReadRepairs int64 `json:"read_repairs"`
+	// stale replicas the winning entry was pushed to
+	ReadRepairWrites int64 `json:"read_repair_writes"`
+	// pushes that failed, anti-entropy catches those later
+	ReadRepairFailures int64 `json:"read_repair_failures"`
+	// entries removed from this node after their TTL ran out
+	Expired int64 `json:"expired"`
+	// tombstones removed from this node after their grace period
+	TombstonesCollected int64 `json:"tombstones_collected"`
+}
+
+func (d *DHT) Metrics() Metrics {
+	return Metrics{
+		Reads:               d.metrics.reads.Load(),
+		ReadRepairs:         d.metrics.readRepairs.Load(),
+		ReadRepairWrites:    d.metrics.readRepairWrites.Load(),
+		ReadRepairFailures:  d.metrics.readRepairFailures.Load(),
+		Expired:             d.metrics.expired.Load(),
+		TombstonesCollected: d.metrics.tombstonesCollected.Load(),
+	}
+}
+
+// waits for the replicas a read didn't wait for, then pushes the newest
+// entry to every replica that answered with something older
+func (d *DHT) readRepair(key string, merged DataEntry, replies []replicaReply, late <-chan replicaReply, remaining int) {
+	for i := 0; i < remaining; i++ {
+		res := <-late
+		if res.err != nil {
+			continue
+		}
+		replies = append(replies, res)
+		if res.found {
+			merged = mergeEntries(merged, res.entry)
+		}
+	}
+
+	want := entryDigest(key, merged)
+	var stale []string
+	for _, res := range replies {
+		if !res.found || entryDigest(key, res.entry) != want {
+			stale = append(stale, res.node)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	d.metrics.readRepairs.Add(1)
+
+	for _, node := range stale {
+		var err error
+		if node == d.selfNode {
+			err = d.apply(key, merged)
+		} else {
+			err = d.sendToNode(context.Background(), node, key, merged)
+		}
+		if err != nil {
+			log.Printf("Read repair of %s on %s failed: %v", key, node, err)
+			d.metrics.readRepairFailures.Add(1)
+			continue
+		}
+		d.metrics.readRepairWrites.Add(1)
+	}
+}
@@ -0,0 +1,226 @@
+package node
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// tokens each physical node gets on the ring unless configured otherwise
+const DefaultVirtualNodes = 64
+
+// a consistent hash ring, each node is placed at several points (virtual
+// nodes) so keys spread evenly and only a small share moves when membership
+// changes
+type Ring struct {
+	lock   sync.RWMutex
+	vnodes int
+	points []RingPoint
+	nodes  map[string]bool
+	// each added node's tokens, in vnode order
+	tokens map[string][]uint32
+}
+
+// a single token on the ring
+type RingPoint struct {
+	Hash uint32 `json:"hash"`
+	Node string `json:"node"`
+}
+
+func NewRing(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		vnodes: vnodes,
+		nodes:  make(map[string]bool),
+		tokens: make(map[string][]uint32),
+	}
+}
+
+func (r *Ring) Add(node string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	r.tokens[node] = nodeTokens(node, r.vnodes)
+
+	added := make([]RingPoint, len(r.tokens[node]))
+	for i, h := range r.tokens[node] {
+		added[i] = RingPoint{Hash: h, Node: node}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].Hash < added[j].Hash })
+
+	// merged into the sorted points, ties are broken by node name so every
+	// member builds the same ring
+	merged := make([]RingPoint, 0, len(r.points)+len(added))
+	i, j := 0, 0
+	for i < len(r.points) || j < len(added) {
+		if j == len(added) || i < len(r.points) && pointLess(r.points[i], added[j]) {
+			merged = append(merged, r.points[i])
+			i++
+		} else {
+			merged = append(merged, added[j])
+			j++
+		}
+	}
+	r.points = merged
+}
+
+func pointLess(a, b RingPoint) bool {
+	if a.Hash != b.Hash {
+		return a.Hash < b.Hash
+	}
+	return a.Node < b.Node
+}
+
+func (r *Ring) Remove(node string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	delete(r.tokens, node)
+
+	kept := r.points[:0]
+	for _, p := range r.points {
+		if p.Node != node {
+			kept = append(kept, p)
+		}
+	}
+	r.points = kept
+}
+
+// the first n distinct nodes found walking clockwise from the key's hash,
+// the first one is the key's primary owner
+func (r *Ring) Owners(key string, n int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].Hash >= h
+	})
+	return r.ownersFrom(start, n)
+}
+
+// like Owners but placing key among candidates only, which need not have
+// been added. Every node given the same candidates computes the same owners.
+func (r *Ring) OwnersAmong(key string, candidates []string, n int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	h := ringHash(key)
+	// a node's distance is how far clockwise from the key its first token is
+	dist := make(map[string]uint32, len(candidates))
+	for _, node := range candidates {
+		if _, ok := dist[node]; ok {
+			continue
+		}
+		tokens, ok := r.tokens[node]
+		if !ok {
+			tokens = nodeTokens(node, r.vnodes)
+		}
+		best := ^uint32(0)
+		for _, t := range tokens {
+			if t-h < best {
+				best = t - h
+			}
+		}
+		dist[node] = best
+	}
+
+	owners := make([]string, 0, len(dist))
+	for node := range dist {
+		owners = append(owners, node)
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		if dist[owners[i]] != dist[owners[j]] {
+			return dist[owners[i]] < dist[owners[j]]
+		}
+		return owners[i] < owners[j]
+	})
+	if len(owners) > n {
+		owners = owners[:n]
+	}
+	return owners
+}
+
+// the other nodes that own at least one range of keys together with node
+// when every key has n owners
+func (r *Ring) CoReplicas(node string, n int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	seen := map[string]bool{node: true}
+	var peers []string
+	// every key between two consecutive tokens has the same owners
+	for start := range r.points {
+		owners := r.ownersFrom(start, n)
+		mine := false
+		for _, o := range owners {
+			mine = mine || o == node
+		}
+		if !mine {
+			continue
+		}
+		for _, o := range owners {
+			if !seen[o] {
+				seen[o] = true
+				peers = append(peers, o)
+			}
+		}
+	}
+	return peers
+}
+
+// like Owners for keys that hash onto token start, callers hold r.lock
+func (r *Ring) ownersFrom(start, n int) []string {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	owners := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.Node] {
+			seen[p.Node] = true
+			owners = append(owners, p.Node)
+		}
+	}
+	return owners
+}
+
+// every token on the ring in hash order
+func (r *Ring) Points() []RingPoint {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return append([]RingPoint{}, r.points...)
+}
+
+func nodeTokens(node string, vnodes int) []uint32 {
+	tokens := make([]uint32, vnodes)
+	for i := range tokens {
+		tokens[i] = ringHash(node + "#" + strconv.Itoa(i))
+	}
+	return tokens
+}
+
+// FNV-1a followed by the murmur3 finalizer, FNV alone leaves keys that differ
+// only in a suffix ("node#1", "node#2") clustered on the ring
+func ringHash(key string) uint32 {
+	h := Hash(key)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
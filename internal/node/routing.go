@@ -0,0 +1,173 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+const (
+	// bits in a node ID, one k-bucket per bit
+	IDLength = sha1.Size * 8
+	// contacts kept per k-bucket and returned by FIND_NODE
+	BucketSize = 20
+)
+
+// a position in the Kademlia keyspace, nodes and keys share it so the nodes
+// responsible for a key are the ones closest to it by XOR distance
+type NodeID [sha1.Size]byte
+
+func NewNodeID(s string) NodeID {
+	return NodeID(sha1.Sum([]byte(s)))
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, ErrInvalidNodeID
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func (id NodeID) Xor(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// whether id is closer to target than other is
+func (id NodeID) Closer(other, target NodeID) bool {
+	a, b := id.Xor(target), other.Xor(target)
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// index of the bucket other belongs in, the number of leading bits it shares
+// with id, or -1 when they are equal
+func (id NodeID) commonPrefixLen(other NodeID) int {
+	d := id.Xor(other)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+// a node known to the routing table
+type Contact struct {
+	ID   NodeID `json:"-"`
+	Addr string `json:"addr"`
+}
+
+func NewContact(addr string) Contact {
+	return Contact{ID: NewNodeID(addr), Addr: addr}
+}
+
+// the k-buckets of a single node. Bucket i holds contacts that share exactly
+// i leading bits with self, each ordered least recently seen first.
+type RoutingTable struct {
+	lock    sync.RWMutex
+	self    Contact
+	buckets [IDLength][]Contact
+}
+
+func NewRoutingTable(self string) *RoutingTable {
+	return &RoutingTable{self: NewContact(self)}
+}
+
+func (rt *RoutingTable) Self() Contact {
+	return rt.self
+}
+
+// marks addr as just seen. When its bucket is full nothing is added and the
+// least recently seen contact is returned so the caller can ping it and
+// evict it if it is gone, live old contacts are preferred to new ones.
+func (rt *RoutingTable) Update(addr string) (Contact, bool) {
+	c := NewContact(addr)
+	i := rt.self.ID.commonPrefixLen(c.ID)
+	if i < 0 {
+		return Contact{}, false
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	bucket := rt.buckets[i]
+	for j, existing := range bucket {
+		if existing.Addr == addr {
+			rt.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return Contact{}, false
+		}
+	}
+	if len(bucket) < BucketSize {
+		rt.buckets[i] = append(bucket, c)
+		return Contact{}, false
+	}
+	return bucket[0], true
+}
+
+func (rt *RoutingTable) Remove(addr string) {
+	c := NewContact(addr)
+	i := rt.self.ID.commonPrefixLen(c.ID)
+	if i < 0 {
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	bucket := rt.buckets[i]
+	for j, existing := range bucket {
+		if existing.Addr == addr {
+			rt.buckets[i] = append(bucket[:j:j], bucket[j+1:]...)
+			return
+		}
+	}
+}
+
+// up to n known contacts ordered by XOR distance to target
+func (rt *RoutingTable) Closest(target NodeID, n int) []Contact {
+	contacts := rt.Contacts()
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+func (rt *RoutingTable) Contacts() []Contact {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+	var contacts []Contact
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	return contacts
+}
+
+func (rt *RoutingTable) Len() int {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(contacts []Contact, target NodeID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].ID.Closer(contacts[j].ID, target)
+	})
+}
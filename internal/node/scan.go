@@ -0,0 +1,55 @@
+package node
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// a key returned by Scan with its entry
+type ScanEntry struct {
+	Key   string    `json:"key"`
+	Entry DataEntry `json:"entry"`
+}
+
+// up to limit of this node's keys under prefix that sort after startAfter,
+// in key order, without asking any replica. Expired and deleted keys are
+// skipped. Passing the last key returned as startAfter gives the next page,
+// fewer than limit keys means there are no more. A limit <= 0 returns every
+// matching key.
+func (d *DHT) Scan(prefix, startAfter string, limit int) ([]ScanEntry, error) {
+	start := prefix
+	if startAfter != "" && startAfter >= prefix {
+		// the smallest key after startAfter
+		start = startAfter + "\x00"
+	}
+
+	var page []ScanEntry
+	now := time.Now()
+	err := d.store.Iterate(start, func(key string, entry DataEntry) bool {
+		if !strings.HasPrefix(key, prefix) {
+			// keys come in order, none after this one match either
+			return false
+		}
+		if entry, live := liveEntry(entry, now); live {
+			if entry, visible := visibleEntry(entry); visible {
+				page = append(page, ScanEntry{Key: key, Entry: entry})
+			}
+		}
+		return limit <= 0 || len(page) < limit
+	})
+	return page, err
+}
+
+// every key this node holds, prefer Scan on nodes holding many keys
+func (d *DHT) GetAllData() map[string]interface{} {
+	entries, err := d.Scan("", "", 0)
+	if err != nil {
+		log.Printf("Failed to read data: %v", err)
+	}
+	data := make(map[string]interface{}, len(entries))
+	for _, e := range entries {
+		data[e.Key] = e.Entry
+	}
+	return data
+}
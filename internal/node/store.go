@@ -0,0 +1,141 @@
+package node
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+var ErrStoreClosed = errors.New("store closed")
+
+var (
+	_ Store = (*MemStore)(nil)
+	_ Store = (*WALStore)(nil)
+	_ Store = (*BoltStore)(nil)
+)
+
+// the storage engine beneath a DHT, it holds this node's copy of every key.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	Get(key string) (DataEntry, bool, error)
+	Put(key string, entry DataEntry) error
+	Delete(key string) error
+	// calls fn for every key >= start in key order until fn returns false
+	Iterate(start string, fn func(key string, entry DataEntry) bool) error
+	// applies every change in b at once, a crash leaves all or none of them
+	Batch(b *Batch) error
+	Close() error
+}
+
+// a set of changes to apply together with Store.Batch
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	Key    string    `json:"key"`
+	Entry  DataEntry `json:"entry"`
+	Delete bool      `json:"delete,omitempty"`
+}
+
+func (b *Batch) Put(key string, entry DataEntry) {
+	b.ops = append(b.ops, batchOp{Key: key, Entry: entry})
+}
+
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{Key: key, Delete: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// picks where a DHT keeps its data. Only OpenDHT takes one, as reading data
+// back can fail; NewDHT always keeps it in memory.
+type StoreOption func(*DHT)
+
+// keeps the node's data in s
+func WithStore(s Store) StoreOption {
+	return func(d *DHT) {
+		d.store = s
+	}
+}
+
+type memItem struct {
+	key   string
+	entry DataEntry
+}
+
+func lessMemItem(a, b memItem) bool {
+	return a.key < b.key
+}
+
+// a Store that keeps entries in an ordered in-memory tree, nothing survives
+// a restart
+type MemStore struct {
+	lock sync.RWMutex
+	tree *btree.BTreeG[memItem]
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{tree: btree.NewG(32, lessMemItem)}
+}
+
+func (s *MemStore) Get(key string) (DataEntry, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	item, ok := s.tree.Get(memItem{key: key})
+	return item.entry, ok, nil
+}
+
+func (s *MemStore) Put(key string, entry DataEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tree.ReplaceOrInsert(memItem{key: key, entry: entry})
+	return nil
+}
+
+func (s *MemStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tree.Delete(memItem{key: key})
+	return nil
+}
+
+// fn runs under the store's read lock and must not write to it
+func (s *MemStore) Iterate(start string, fn func(key string, entry DataEntry) bool) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.tree.AscendGreaterOrEqual(memItem{key: start}, func(item memItem) bool {
+		return fn(item.key, item.entry)
+	})
+	return nil
+}
+
+func (s *MemStore) Batch(b *Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.applyLocked(b.ops)
+	return nil
+}
+
+func (s *MemStore) applyLocked(ops []batchOp) {
+	for _, op := range ops {
+		if op.Delete {
+			s.tree.Delete(memItem{key: op.Key})
+		} else {
+			s.tree.ReplaceOrInsert(memItem{key: op.Key, entry: op.Entry})
+		}
+	}
+}
+
+func (s *MemStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tree.Len()
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
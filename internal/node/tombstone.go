@@ -0,0 +1,33 @@
+package node
+
+import (
+	"context"
+	"time"
+)
+
+// how long a tombstone is kept by default before it is garbage collected
+const DefaultTombstoneGrace = 24 * time.Hour
+
+// sets how long tombstones written by this node are kept before every
+// replica removes them. It must outlast the longest a replica can miss the
+// delete, through hinted handoff or anti-entropy, or the key may come back.
+func WithTombstoneGrace(grace time.Duration) Option {
+	return func(d *DHT) {
+		d.tombstoneGrace = grace
+	}
+}
+
+// deletes key from the N replicas that own it by writing a tombstone, a
+// version that supersedes what opts.Context has seen, or what a majority of
+// the owners hold when it is nil, and replicates like any other write. Reads
+// treat the key as missing from then on.
+func (d *DHT) Delete(ctx context.Context, key string, opts WriteOpts) error {
+	return d.write(ctx, key, "", true, opts)
+}
+
+// e without its tombstones, false if it holds nothing but tombstones
+func visibleEntry(e DataEntry) (DataEntry, bool) {
+	return filterVersions(e, func(v DataEntry) bool {
+		return !v.Deleted
+	})
+}
@@ -0,0 +1,323 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+
+	// how often the WAL is folded into a snapshot by default
+	DefaultSnapshotInterval = 5 * time.Minute
+)
+
+// keeps the node's data in a WALStore in dir, see OpenWALStore
+func WithDataDir(dir string, snapshotInterval time.Duration) StoreOption {
+	return func(d *DHT) {
+		d.dataDir = dir
+		d.snapshotInterval = snapshotInterval
+	}
+}
+
+// a Store that serves reads from memory and makes every change durable by
+// appending it to a write-ahead log and fsyncing before it returns. The log
+// is compacted into a snapshot every interval and on Close.
+type WALStore struct {
+	mem *MemStore
+
+	// orders log appends the same as the changes they describe
+	lock sync.Mutex
+	dir  string
+	file *os.File
+	// length of the intact records in file, a failed append is cut back to it
+	size int64
+	// set once the log can't be trusted to end in an intact record, every
+	// later change is refused with it
+	failed error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// recovers the snapshot and log in dir, creating dir if needed. A record torn
+// by a crash is dropped along with anything after it.
+func OpenWALStore(dir string, snapshotInterval time.Duration) (*WALStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create data dir: %v", err)
+	}
+
+	s := &WALStore{mem: NewMemStore(), dir: dir, done: make(chan struct{})}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %v", err)
+	}
+	valid, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// drop a torn tail so new records follow the last good one
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("truncate wal: %v", err)
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("seek wal: %v", err)
+	}
+	s.file = f
+	s.size = valid
+
+	if snapshotInterval <= 0 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+	go s.snapshotLoop(snapshotInterval)
+	return s, nil
+}
+
+func (s *WALStore) Get(key string) (DataEntry, bool, error) {
+	return s.mem.Get(key)
+}
+
+func (s *WALStore) Put(key string, entry DataEntry) error {
+	var b Batch
+	b.Put(key, entry)
+	return s.Batch(&b)
+}
+
+func (s *WALStore) Delete(key string) error {
+	var b Batch
+	b.Delete(key)
+	return s.Batch(&b)
+}
+
+func (s *WALStore) Iterate(start string, fn func(key string, entry DataEntry) bool) error {
+	return s.mem.Iterate(start, fn)
+}
+
+// logs the whole batch as one record, so it replays entirely or not at all
+func (s *WALStore) Batch(b *Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return ErrStoreClosed
+	}
+	if s.failed != nil {
+		return s.failed
+	}
+	if err := s.append(b.ops); err != nil {
+		return err
+	}
+	return s.mem.Batch(b)
+}
+
+func (s *WALStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if err = s.snapshot(); err != nil {
+			log.Printf("Failed to snapshot %s on close: %v", s.dir, err)
+		}
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+		s.file = nil
+	})
+	return err
+}
+
+func (s *WALStore) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open snapshot: %v", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var ops []batchOp
+	for {
+		var op batchOp
+		if err := dec.Decode(&op); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("decode snapshot: %v", err)
+		}
+		ops = append(ops, op)
+	}
+	s.mem.applyLocked(ops)
+	return nil
+}
+
+// applies every intact record of r and returns the length of the intact prefix
+func (s *WALStore) replay(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Dropping torn WAL record at offset %d", valid)
+			}
+			return valid, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read wal: %v", err)
+		}
+
+		ops, ok := decodeWALRecord(line)
+		if !ok {
+			log.Printf("Dropping corrupt WAL record at offset %d", valid)
+			return valid, nil
+		}
+		s.mem.applyLocked(ops)
+		valid += int64(len(line))
+	}
+}
+
+// a record is one line, the CRC32 of its body in hex and the body
+func decodeWALRecord(line []byte) ([]batchOp, bool) {
+	sum, body, found := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !found {
+		return nil, false
+	}
+	want, err := strconv.ParseUint(string(sum), 16, 32)
+	if err != nil || crc32.ChecksumIEEE(body) != uint32(want) {
+		return nil, false
+	}
+	var ops []batchOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return nil, false
+	}
+	return ops, true
+}
+
+// appends ops as one record and fsyncs, they are durable once this returns.
+// A partly written record is cut off again so later records don't follow
+// bytes replay would stop at. When that fails too, or the fsync does and
+// what reached the disk is unknown, the store refuses every later change.
+func (s *WALStore) append(ops []batchOp) error {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(body), body)
+	if _, err := s.file.WriteString(line); err != nil {
+		err = fmt.Errorf("write wal: %v", err)
+		if cutErr := s.cut(); cutErr != nil {
+			s.failed = fmt.Errorf("wal failed: %v, then %v", err, cutErr)
+		}
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		err = fmt.Errorf("sync wal: %v", err)
+		s.cut()
+		s.failed = fmt.Errorf("wal failed: %v", err)
+		return err
+	}
+	s.size += int64(len(line))
+	return nil
+}
+
+// drops everything after the last intact record
+func (s *WALStore) cut() error {
+	if err := s.file.Truncate(s.size); err != nil {
+		return fmt.Errorf("truncate wal: %v", err)
+	}
+	if _, err := s.file.Seek(s.size, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %v", err)
+	}
+	return nil
+}
+
+// writes every entry to a new snapshot and empties the log, callers hold
+// s.lock. The snapshot is renamed into place so a crash leaves either the old
+// or the new one, and records a crash leaves in the log replay harmlessly.
+func (s *WALStore) snapshot() error {
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	s.mem.Iterate("", func(key string, entry DataEntry) bool {
+		err = enc.Encode(batchOp{Key: key, Entry: entry})
+		return err == nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write snapshot: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return fmt.Errorf("rename snapshot: %v", err)
+	}
+	syncDir(s.dir)
+
+	// records left behind would replay harmlessly, but new ones must not be
+	// cut back to an offset that no longer matches the file
+	s.size = 0
+	if err := s.cut(); err != nil {
+		s.failed = fmt.Errorf("wal failed: %v", err)
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *WALStore) snapshotLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.lock.Lock()
+		if s.file != nil {
+			if err := s.snapshot(); err != nil {
+				log.Printf("Failed to snapshot %s: %v", s.dir, err)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// makes a rename in dir durable, not every platform supports it
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
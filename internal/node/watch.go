@@ -0,0 +1,350 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+const (
+	msgWatch   = "dht_watch"
+	msgUnwatch = "dht_unwatch"
+	msgEvent   = "dht_event"
+
+	// events queued for a watcher, or for sending to one on another node,
+	// that isn't keeping up before newer ones are dropped
+	watchBuffer = 64
+	// how long a delivered change is remembered, to drop the same change
+	// when the key's other replicas report it
+	watchDedupWindow = time.Minute
+)
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// a change to a key, as seen by one of the nodes holding it
+type Event struct {
+	Type EventType `json:"type"`
+	Key  string    `json:"key"`
+	// the key's value after a put, the latest write when it has siblings
+	Value   string `json:"value,omitempty"`
+	Version int64  `json:"version"`
+	// the node whose copy of the key changed
+	Node  string      `json:"node"`
+	Clock VectorClock `json:"clock,omitempty"`
+}
+
+type watchRequest struct {
+	ID     string `json:"id"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+type eventRequest struct {
+	ID    string `json:"id"`
+	Event Event  `json:"event"`
+}
+
+// a Watch on this node
+type watch struct {
+	id     string
+	prefix string
+	ch     chan Event
+	// what was last delivered for each recently changed key, so a change
+	// reported by every replica holding the key is delivered once. Keys are
+	// forgotten after watchDedupWindow, the map only holds recent changes.
+	seen      map[string]seenChange
+	lastSweep time.Time
+}
+
+type seenChange struct {
+	typ   EventType
+	clock VectorClock
+	at    time.Time
+}
+
+// a Watch on another node, sent every change to our copy of its keys
+type subscriber struct {
+	addr   string
+	id     string
+	prefix string
+	// changes not sent yet, oldest first, see pushLoop
+	queue chan Event
+	// closed once the watch is forgotten
+	done chan struct{}
+}
+
+// streams puts and deletes of keys under prefix until ctx is done or the DHT
+// closes, then closes the channel. Changes are reported by every node holding
+// the key, this one included, and each is delivered once unless a replica
+// reports it more than watchDedupWindow after the first. Nodes that join or
+// reconnect later are subscribed to as they appear. A watcher falling more
+// than watchBuffer events behind misses events rather than holding up writes.
+func (d *DHT) Watch(ctx context.Context, prefix string) <-chan Event {
+	w := &watch{
+		id:     p2p.NewMessageID(),
+		prefix: prefix,
+		ch:     make(chan Event, watchBuffer),
+		seen:   make(map[string]seenChange),
+	}
+	d.watchLock.Lock()
+	if d.watches == nil {
+		d.watches = make(map[string]*watch)
+	}
+	d.watches[w.id] = w
+	d.watchLock.Unlock()
+
+	// changes made once Watch returns reach us from every node that answered
+	var wg sync.WaitGroup
+	for _, node := range d.ListNodes() {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			d.subscribe(ctx, node, w)
+		}(node)
+	}
+	wg.Wait()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-d.done:
+		}
+		d.watchLock.Lock()
+		delete(d.watches, w.id)
+		close(w.ch)
+		d.watchLock.Unlock()
+
+		if ctx.Err() == nil {
+			return
+		}
+		for _, node := range d.ListNodes() {
+			go d.send(context.Background(), node, msgUnwatch, watchRequest{ID: w.id})
+		}
+	}()
+	return w.ch
+}
+
+// asks node to send us its changes to keys under w's prefix
+func (d *DHT) subscribe(ctx context.Context, node string, w *watch) {
+	if err := d.send(ctx, node, msgWatch, watchRequest{ID: w.id, Prefix: w.prefix}); err != nil {
+		log.Printf("Failed to watch %q on %s: %v", w.prefix, node, err)
+	}
+}
+
+// subscribes every active watch to node, which has joined or reconnected
+func (d *DHT) resubscribe(node string) {
+	d.watchLock.Lock()
+	watches := make([]*watch, 0, len(d.watches))
+	for _, w := range d.watches {
+		watches = append(watches, w)
+	}
+	d.watchLock.Unlock()
+
+	for _, w := range watches {
+		d.subscribe(context.Background(), node, w)
+	}
+}
+
+func (d *DHT) onWatchPeerConnected(peer p2p.Peer) {
+	addr := peer.RemoteAddr()
+	for _, node := range d.ListNodes() {
+		if node == addr {
+			go d.resubscribe(addr)
+			return
+		}
+	}
+}
+
+// reports a change of our copy of key, before and after as held in the
+// store, to the anti-entropy index and the watches it concerns. Callers hold
+// d.lock so changes to a key are reported in the order they were made.
+func (d *DHT) changed(key string, before DataEntry, hadBefore bool, after DataEntry, hasAfter bool) {
+	d.merkle.update(key, after, hasAfter)
+
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	if len(d.watches) == 0 && len(d.subscribers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	visible := func(e DataEntry, found bool) (DataEntry, bool) {
+		if found {
+			e, found = liveEntry(e, now)
+		}
+		if found {
+			e, found = visibleEntry(e)
+		}
+		return e, found
+	}
+	old, wasVisible := visible(before, hadBefore)
+	cur, isVisible := visible(after, hasAfter)
+
+	var ev Event
+	switch {
+	case isVisible && (!wasVisible || entryDigest(key, old) != entryDigest(key, cur)):
+		ev = Event{Type: EventPut, Key: key, Value: cur.Value, Version: cur.Version, Clock: cur.Context()}
+	case wasVisible && !isVisible:
+		ev = Event{Type: EventDelete, Key: key, Version: old.Version, Clock: old.Context()}
+		if hasAfter {
+			// the tombstone
+			ev.Version, ev.Clock = after.Version, after.Context()
+		}
+	default:
+		return
+	}
+	ev.Node = d.selfNode
+
+	for _, w := range d.watches {
+		if strings.HasPrefix(key, w.prefix) {
+			w.deliver(ev)
+		}
+	}
+	for _, s := range d.subscribers {
+		if !strings.HasPrefix(key, s.prefix) {
+			continue
+		}
+		select {
+		case s.queue <- ev:
+		default:
+			log.Printf("Dropping %s event for %s, watcher on %s is %d events behind", ev.Type, ev.Key, s.addr, watchBuffer)
+		}
+	}
+}
+
+// hands ev to the watcher unless it has seen the change already, callers hold
+// d.watchLock
+func (w *watch) deliver(ev Event) {
+	now := time.Now()
+	if now.Sub(w.lastSweep) >= watchDedupWindow {
+		for key, c := range w.seen {
+			if now.Sub(c.at) >= watchDedupWindow {
+				delete(w.seen, key)
+			}
+		}
+		w.lastSweep = now
+	}
+
+	if last, ok := w.seen[ev.Key]; ok {
+		switch ev.Clock.Compare(last.clock) {
+		case Before:
+			return
+		case Equal:
+			// an expiry keeps the clock of the put it removes
+			if ev.Type == last.typ {
+				return
+			}
+		case Concurrent:
+			ev.Clock = ev.Clock.Merge(last.clock)
+		}
+	}
+	w.seen[ev.Key] = seenChange{typ: ev.Type, clock: ev.Clock, at: now}
+
+	select {
+	case w.ch <- ev:
+	default:
+		log.Printf("Dropping %s event for %s, watcher is %d events behind", ev.Type, ev.Key, watchBuffer)
+	}
+}
+
+// sends a watch on another node its events one at a time, in the order they
+// happened, until the watch ends. A failed send forgets the watch, the node
+// subscribes again once it reconnects.
+func (d *DHT) pushLoop(s *subscriber) {
+	for {
+		var ev Event
+		select {
+		case ev = <-s.queue:
+		case <-s.done:
+			return
+		case <-d.done:
+			return
+		}
+
+		if err := d.send(context.Background(), s.addr, msgEvent, eventRequest{ID: s.id, Event: ev}); err != nil {
+			log.Printf("Dropping watch of %s: %v", s.addr, err)
+			d.watchLock.Lock()
+			d.unsubscribeLocked(s.addr + "/" + s.id)
+			d.watchLock.Unlock()
+			return
+		}
+	}
+}
+
+// forgets a watch on another node, callers hold d.watchLock
+func (d *DHT) unsubscribeLocked(key string) {
+	if s, ok := d.subscribers[key]; ok {
+		delete(d.subscribers, key)
+		close(s.done)
+	}
+}
+
+func (d *DHT) handleWatch(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req watchRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode watch payload: %v", err)
+	}
+	if req.ID == "" || msg.Sender == "" {
+		return p2p.Message{}, errors.New("watch payload missing id or sender")
+	}
+
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	if d.subscribers == nil {
+		d.subscribers = make(map[string]*subscriber)
+	}
+	key := msg.Sender + "/" + req.ID
+	if _, ok := d.subscribers[key]; !ok {
+		s := &subscriber{
+			addr:   msg.Sender,
+			id:     req.ID,
+			prefix: req.Prefix,
+			queue:  make(chan Event, watchBuffer),
+			done:   make(chan struct{}),
+		}
+		d.subscribers[key] = s
+		go d.pushLoop(s)
+	}
+	return p2p.Message{Type: msgAck}, nil
+}
+
+func (d *DHT) handleUnwatch(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req watchRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode unwatch payload: %v", err)
+	}
+
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	d.unsubscribeLocked(msg.Sender + "/" + req.ID)
+	return p2p.Message{Type: msgAck}, nil
+}
+
+// delivers a change reported by another node, failing for a watch that has
+// ended so the node stops sending
+func (d *DHT) handleEvent(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+	var req eventRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return p2p.Message{}, fmt.Errorf("decode event payload: %v", err)
+	}
+
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	w, ok := d.watches[req.ID]
+	if !ok {
+		return p2p.Message{}, errors.New("no such watch")
+	}
+	w.deliver(req.Event)
+	return p2p.Message{Type: msgAck}, nil
+}
@@ -1,24 +1,24 @@
 package main
 
 import (
-	// "crypto/tls"
-	// "crypto/x509"
+	"context"
 	"encoding/json"
 	"flag"
-
-	// "fmt"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
-	// "path/filepath"
-
-	// "github.com/abdealijaroli/godfs/config"
+	"github.com/abdealijaroli/godfs/config"
 	"github.com/abdealijaroli/godfs/internal/file"
 	"github.com/abdealijaroli/godfs/internal/node"
-	// "github.com/abdealijaroli/godfs/pkg/p2p"
+	"github.com/abdealijaroli/godfs/pkg/p2p"
 )
 
 // DHT network monitor
@@ -45,6 +45,9 @@ func (s *DebugServer) Handler(port string) http.Handler {
 	mux.HandleFunc("/api/data", s.handleData)
 	mux.HandleFunc("/api/ring", s.handleRing)
 	mux.HandleFunc("/api/chunks", s.handleChunks)
+	mux.HandleFunc("/api/hints", s.handleHints)
+	mux.HandleFunc("/api/metrics", s.handleMetrics)
+	mux.HandleFunc("/api/watch", s.handleWatch)
 	mux.HandleFunc("/api/upload", s.handleUpload)
 	mux.HandleFunc("/api/health", s.handleHealth)
 
@@ -97,30 +100,111 @@ func (s *DebugServer) handleNodes(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(s.dht.ListNodes())
 }
 
+func (s *DebugServer) handleHints(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dht.PendingHints())
+}
+
+func (s *DebugServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dht.Metrics())
+}
+
+// streams changes to keys under ?prefix= as server-sent events
+func (s *DebugServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for event := range s.dht.Watch(r.Context(), r.URL.Query().Get("prefix")) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+const (
+	// keys per page of /api/data and /api/chunks unless ?limit= says otherwise
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// one page of a listing, request the next with ?after=<next>
+type dataPage struct {
+	Entries []node.ScanEntry `json:"entries"`
+	// empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// scans the page selected by ?prefix=, ?after= and ?limit=
+func (s *DebugServer) scanPage(r *http.Request) (dataPage, error) {
+	query := r.URL.Query()
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return dataPage{}, fmt.Errorf("invalid limit %q", v)
+		}
+		limit = min(n, maxPageSize)
+	}
+
+	entries, err := s.dht.Scan(query.Get("prefix"), query.Get("after"), limit)
+	if err != nil {
+		return dataPage{}, err
+	}
+	page := dataPage{Entries: append([]node.ScanEntry{}, entries...)}
+	if len(entries) == limit {
+		page.Next = entries[len(entries)-1].Key
+	}
+	return page, nil
+}
+
 func (s *DebugServer) handleData(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(s.dht.GetAllData())
+	page, err := s.scanPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
 }
 
 func (s *DebugServer) handleRing(w http.ResponseWriter, r *http.Request) {
-	nodes := s.dht.ListNodes()
-	ringData := make([]uint32, len(nodes))
-	for i, n := range nodes {
-		ringData[i] = node.Hash(n)
-	}
-	json.NewEncoder(w).Encode(ringData)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dht.RingPoints())
 }
 
+// like /api/data but lists every version of each key
 func (s *DebugServer) handleChunks(w http.ResponseWriter, r *http.Request) {
-	chunkData := make(map[string][]node.DataEntry)
-	for key, value := range s.dht.GetAllData() {
-		dataEntry, ok := value.(node.DataEntry)
-		if !ok {
-			http.Error(w, "invalid data entry type", http.StatusInternalServerError)
-			return
-		}
-		chunkData[key] = append(chunkData[key], dataEntry)
+	page, err := s.scanPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type chunk struct {
+		Key      string           `json:"key"`
+		Versions []node.DataEntry `json:"versions"`
 	}
-	json.NewEncoder(w).Encode(chunkData)
+	var out struct {
+		Chunks []chunk `json:"chunks"`
+		Next   string  `json:"next,omitempty"`
+	}
+	out.Chunks = make([]chunk, 0, len(page.Entries))
+	for _, e := range page.Entries {
+		out.Chunks = append(out.Chunks, chunk{Key: e.Key, Versions: e.Entry.Versions()})
+	}
+	out.Next = page.Next
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
 }
 
 func (s *DebugServer) handleUpload(w http.ResponseWriter, r *http.Request) {
@@ -186,27 +270,106 @@ func (s *DebugServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	port := flag.String("port", "8000", "Port to run the server on")
+	p2pPort := flag.String("p2p-port", "9000", "Port for node-to-node traffic")
+	useTLS := flag.Bool("tls", false, "Secure node-to-node traffic with mutual TLS using certs/")
+	mode := flag.String("type", "", "Run a standalone TLS transport demo: serve or dial")
+	dataDir := flag.String("data-dir", "data", "Directory to keep this node's data in, one subdirectory per p2p port")
+	storeType := flag.String("store", "wal", "Storage engine for this node's data: mem, wal or bolt")
+	bootstrap := flag.String("bootstrap", "localhost:9443", "Comma separated node addresses to join the cluster through")
+	codecs := flag.String("codecs", "", "Comma separated codecs for node-to-node traffic, most preferred first: protobuf, msgpack or json (default all three)")
 	flag.Parse()
 
-	// Create DHT without TLS for Dev mode
-	dht := node.NewDHT("localhost:" + *port)
+	switch *mode {
+	case "serve":
+		Serve()
+		return
+	case "dial":
+		Dial()
+		return
+	}
+
+	// Dev mode runs without TLS unless asked for
+	opts := []node.Option{
+		node.WithHintedHandoff(node.DefaultHintReplayInterval),
+		node.WithAntiEntropy(node.DefaultAntiEntropyInterval),
+	}
+
+	var storage node.StoreOption
+	dir := filepath.Join(*dataDir, *p2pPort)
+	switch *storeType {
+	case "mem":
+	case "wal":
+		storage = node.WithDataDir(dir, node.DefaultSnapshotInterval)
+	case "bolt":
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatalf("Failed to create data dir: %v", err)
+		}
+		store, err := node.OpenBoltStore(filepath.Join(dir, "data.db"))
+		if err != nil {
+			log.Fatalf("Failed to open store: %v", err)
+		}
+		storage = node.WithStore(store)
+	default:
+		log.Fatalf("Unknown store %q, want mem, wal or bolt", *storeType)
+	}
+	if *useTLS {
+		tlsConfig, err := config.LoadTLSConfig("certs/server.crt", "certs/server.key", "certs/ca.crt")
+		if err != nil {
+			log.Fatalf("Failed to load TLS config: %v", err)
+		}
+		opts = append(opts, node.WithTLSConfig(tlsConfig))
+	}
+	if *codecs != "" {
+		var names []string
+		for _, name := range strings.Split(*codecs, ",") {
+			name = strings.TrimSpace(name)
+			if _, err := p2p.GetCodec(name); err != nil {
+				log.Fatalf("Invalid -codecs: %v", err)
+			}
+			names = append(names, name)
+		}
+		opts = append(opts, node.WithCodecs(names...))
+	}
+
+	selfAddr := "localhost:" + *p2pPort
+	dht, err := node.OpenDHT(selfAddr, storage, opts...)
+	if err != nil {
+		log.Fatalf("Failed to open DHT: %v", err)
+	}
 	fileManager := file.NewFileManager(1024, dht, "storage")
 	debugServer := NewDebugServer(dht, fileManager)
 
-	// Add nodes for Dev mode
-	dht.AddNode("localhost:8443")
-	dht.AddNode("localhost:8444")
-	dht.AddNode("localhost:8445")
-	dht.AddNode("localhost:8446")
-	dht.AddNode("localhost:8447")
-
-	// Create transport without TLS for Dev mode
-	// transport := p2p.NewTCPTransport("localhost:" + *port)
-	// go func() {
-	// 	if err := transport.ListenAndAccept(); err != nil {
-	// 		log.Fatalf("Failed to start transport: %v", err)
-	// 	}
-	// }()
+	// Serve other nodes' requests
+	go func() {
+		if err := dht.ListenAndAccept(); err != nil {
+			log.Fatalf("Failed to start transport: %v", err)
+		}
+	}()
+
+	// Learn the rest of the cluster from the seeds, retrying while they start up
+	go func() {
+		var seeds []string
+		for _, seed := range strings.Split(*bootstrap, ",") {
+			if seed = strings.TrimSpace(seed); seed != "" && seed != selfAddr {
+				seeds = append(seeds, seed)
+			}
+		}
+		// the first node of a cluster waits for the others to find it
+		if len(seeds) == 0 {
+			return
+		}
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := dht.Bootstrap(ctx, seeds...)
+			cancel()
+			if err == nil {
+				log.Printf("Joined cluster, %d nodes known", len(dht.ListNodes()))
+				return
+			}
+			log.Printf("Failed to join cluster: %v", err)
+			time.Sleep(5 * time.Second)
+		}
+	}()
 
 	// Start HTTP server without TLS for Dev mode
 	log.Printf("Starting HTTP server on port %s", *port)
@@ -214,47 +377,3 @@ func main() {
 		panic(err)
 	}
 }
-
-// func main() {
-// 	port := flag.String("port", "8000", "Port to run the server on")
-// 	flag.Parse()
-
-// 	cert, err := tls.LoadX509KeyPair("certs/server.crt", "certs/server.key")
-// 	if err != nil {
-// 		log.Fatalf("Failed to load TLS certificates: %v", err)
-// 	}
-
-// 	caCert, err := os.ReadFile("certs/ca.crt")
-// 	if err != nil {
-// 		log.Fatalf("Failed to load CA certificate: %v", err)
-// 	}
-
-// 	caCertPool := x509.NewCertPool()
-// 	caCertPool.AppendCertsFromPEM(caCert)
-
-// 	tlsConfig := &tls.Config{
-// 		Certificates: []tls.Certificate{cert},
-// 		RootCAs:      caCertPool,
-// 	}
-
-// 	dht := node.NewDHT("localhost:"+*port, tlsConfig)
-// 	fileManager := file.NewFileManager(1024, dht, "storage")
-// 	debugServer := NewDebugServer(dht, fileManager)
-
-// 	dht.AddNode("localhost:8443")
-// 	dht.AddNode("localhost:8444")
-// 	dht.AddNode("localhost:8445")
-// 	dht.AddNode("localhost:8446")
-// 	dht.AddNode("localhost:8447")
-
-// 	transport := p2p.NewTCPTransport("localhost:"+*port, tlsConfig)
-// 	go func() {
-// 		if err := transport.ListenAndAccept(); err != nil {
-// 			log.Fatalf("Failed to start transport: %v", err)
-// 		}
-// 	}()
-
-// 	if err := debugServer.Start(":" + *port); err != nil {
-// 		panic(err)
-// 	}
-// }
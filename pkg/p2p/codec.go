@@ -0,0 +1,193 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// turns messages into frame bodies and back, negotiated per connection
+type Codec interface {
+	Name() string
+	Marshal(msg Message) ([]byte, error)
+	Unmarshal(data []byte, msg *Message) error
+}
+
+const (
+	CodecJSON     = "json"
+	CodecMsgpack  = "msgpack"
+	CodecProtobuf = "protobuf"
+)
+
+// preference order used when a transport is not configured with codecs
+var DefaultCodecs = []string{CodecProtobuf, CodecMsgpack, CodecJSON}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(protobufCodec{})
+}
+
+// makes a codec available for negotiation, replacing any codec with the same name
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[c.Name()] = c
+}
+
+func GetCodec(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// picks the first codec in offered that is also in accepted
+func negotiateCodec(offered, accepted []string) (Codec, error) {
+	for _, o := range offered {
+		for _, a := range accepted {
+			if o == a {
+				return GetCodec(o)
+			}
+		}
+	}
+	return nil, fmt.Errorf("no common codec in %v and %v", offered, accepted)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) Marshal(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return CodecMsgpack }
+
+func (msgpackCodec) Marshal(msg Message) ([]byte, error) {
+	return msgpack.Marshal(&msg)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, msg *Message) error {
+	return msgpack.Unmarshal(data, msg)
+}
+
+// hand-written protobuf wire encoding of Message, equivalent to
+//
+//	message Message {
+//	  string type = 1;
+//	  bytes payload = 2;
+//	  string id = 3;
+//	  string sender = 4;
+//	  int64 timestamp = 5;
+//	}
+type protobufCodec struct{}
+
+const (
+	pbFieldType      protowire.Number = 1
+	pbFieldPayload   protowire.Number = 2
+	pbFieldID        protowire.Number = 3
+	pbFieldSender    protowire.Number = 4
+	pbFieldTimestamp protowire.Number = 5
+)
+
+func (protobufCodec) Name() string { return CodecProtobuf }
+
+func (protobufCodec) Marshal(msg Message) ([]byte, error) {
+	var buf []byte
+	if msg.Type != "" {
+		buf = protowire.AppendTag(buf, pbFieldType, protowire.BytesType)
+		buf = protowire.AppendString(buf, msg.Type)
+	}
+	if len(msg.Payload) > 0 {
+		buf = protowire.AppendTag(buf, pbFieldPayload, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg.Payload)
+	}
+	if msg.ID != "" {
+		buf = protowire.AppendTag(buf, pbFieldID, protowire.BytesType)
+		buf = protowire.AppendString(buf, msg.ID)
+	}
+	if msg.Sender != "" {
+		buf = protowire.AppendTag(buf, pbFieldSender, protowire.BytesType)
+		buf = protowire.AppendString(buf, msg.Sender)
+	}
+	if msg.Timestamp != 0 {
+		buf = protowire.AppendTag(buf, pbFieldTimestamp, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(msg.Timestamp))
+	}
+	return buf, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, msg *Message) error {
+	*msg = Message{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrMalformedMessage, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch {
+		case num == pbFieldType && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformedMessage, protowire.ParseError(n))
+			}
+			msg.Type = v
+			data = data[n:]
+		case num == pbFieldPayload && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformedMessage, protowire.ParseError(n))
+			}
+			msg.Payload = append([]byte(nil), v...)
+			data = data[n:]
+		case num == pbFieldID && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformedMessage, protowire.ParseError(n))
+			}
+			msg.ID = v
+			data = data[n:]
+		case num == pbFieldSender && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformedMessage, protowire.ParseError(n))
+			}
+			msg.Sender = v
+			data = data[n:]
+		case num == pbFieldTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformedMessage, protowire.ParseError(n))
+			}
+			msg.Timestamp = int64(v)
+			data = data[n:]
+		default:
+			// skip unknown fields for forward compatibility
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformedMessage, protowire.ParseError(n))
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the misbehaviour injected into every message that crosses a faulty transport
+type Faults struct {
+	// fixed delay added to every message
+	Latency time.Duration
+	// random extra delay in [0, Jitter), enough on its own to reorder messages
+	Jitter time.Duration
+	// probability in [0, 1] that a message is silently lost
+	DropRate float64
+	// probability in [0, 1] that a message is delivered twice
+	DuplicateRate float64
+	// probability in [0, 1] that a message is held back by ReorderDelay so
+	// later messages overtake it
+	ReorderRate  float64
+	ReorderDelay time.Duration
+}
+
+// drives the faults of any number of wrapped transports, so partitions can be
+// set up between arbitrary pairs of addresses. Decisions come from a seeded
+// source so a failing run can be replayed.
+type Chaos struct {
+	lock       sync.Mutex
+	faults     Faults
+	partitions map[[2]string]bool
+	rng        *rand.Rand
+	timers     []*time.Timer
+}
+
+func NewChaos(seed int64) *Chaos {
+	return &Chaos{
+		partitions: make(map[[2]string]bool),
+		rng:        rand.New(rand.NewSource(seed)),
+	}
+}
+
+// wraps t so that everything it sends and serves is subject to this chaos
+func (c *Chaos) Wrap(t Transport) *FaultyTransport {
+	ft := &FaultyTransport{inner: t, chaos: c, peers: make(map[Peer]struct{})}
+	// Broadcast faults the copy for every peer t would have sent to
+	t.OnPeerConnected(ft.track)
+	t.OnPeerDisconnected(ft.untrack)
+	return ft
+}
+
+func (c *Chaos) SetFaults(f Faults) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.faults = f
+}
+
+// switches to f once after has elapsed
+func (c *Chaos) ScheduleFaults(after time.Duration, f Faults) {
+	c.schedule(after, func() { c.SetFaults(f) })
+}
+
+// cuts traffic between a and b in both directions until Heal is called
+func (c *Chaos) Partition(a, b string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.partitions[pairKey(a, b)] = true
+}
+
+func (c *Chaos) Heal(a, b string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.partitions, pairKey(a, b))
+}
+
+// partitions a and b once after has elapsed and heals them duration later
+func (c *Chaos) SchedulePartition(a, b string, after, duration time.Duration) {
+	c.schedule(after, func() { c.Partition(a, b) })
+	c.schedule(after+duration, func() { c.Heal(a, b) })
+}
+
+// cancels every scheduled change that has not fired yet
+func (c *Chaos) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, t := range c.timers {
+		t.Stop()
+	}
+	c.timers = nil
+}
+
+func (c *Chaos) schedule(after time.Duration, fn func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.timers = append(c.timers, time.AfterFunc(after, fn))
+}
+
+func (c *Chaos) partitioned(a, b string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.partitions[pairKey(a, b)]
+}
+
+// rolls DuplicateRate on its own, for requests whose other faults were
+// decided when they were sent
+func (c *Chaos) duplicate() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rng.Float64() < c.faults.DuplicateRate
+}
+
+// what happens to a single message
+type fate struct {
+	drop      bool
+	duplicate bool
+	delay     time.Duration
+}
+
+func (c *Chaos) decide(from, to string) fate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.partitions[pairKey(from, to)] {
+		return fate{drop: true}
+	}
+
+	f := c.faults
+	out := fate{
+		drop:      c.rng.Float64() < f.DropRate,
+		duplicate: c.rng.Float64() < f.DuplicateRate,
+		delay:     f.Latency,
+	}
+	if f.Jitter > 0 {
+		out.delay += time.Duration(c.rng.Int63n(int64(f.Jitter)))
+	}
+	if c.rng.Float64() < f.ReorderRate {
+		out.delay += f.ReorderDelay
+	}
+	return out
+}
+
+// a Transport that injects the faults of its Chaos into every message
+type FaultyTransport struct {
+	inner Transport
+	chaos *Chaos
+
+	lock   sync.Mutex
+	peers  map[Peer]struct{}
+	closed bool
+}
+
+var (
+	_ Transport = (*FaultyTransport)(nil)
+	_ Peer      = (*faultyPeer)(nil)
+)
+
+func (t *FaultyTransport) Addr() string {
+	return t.inner.Addr()
+}
+
+func (t *FaultyTransport) ListenAndAccept() error {
+	return t.inner.ListenAndAccept()
+}
+
+func (t *FaultyTransport) Dial(address string) (Peer, error) {
+	if t.chaos.partitioned(t.Addr(), address) {
+		return nil, ErrUnreachable
+	}
+	peer, err := t.inner.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyPeer{Peer: peer, chaos: t.chaos, local: t.Addr(), remote: address}, nil
+}
+
+// sends payload to every connected peer concurrently, each copy is
+// partitioned, dropped or delayed on its own like a Send
+func (t *FaultyTransport) Broadcast(payload []byte) error {
+	msg := Message{Type: MessageTypeBroadcast, Payload: payload}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return ErrTransportClosed
+	}
+	peers := make([]Peer, 0, len(t.peers))
+	for peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.lock.Unlock()
+
+	errs := make(chan error, len(peers))
+	for _, peer := range peers {
+		go func(peer Peer) {
+			remote := peer.RemoteAddr()
+			if t.chaos.partitioned(t.Addr(), remote) {
+				errs <- fmt.Errorf("%s: %w", remote, ErrUnreachable)
+				return
+			}
+			if err := sendWithFate(peer, t.chaos.decide(t.Addr(), remote), msg); err != nil {
+				errs <- fmt.Errorf("%s: %w", remote, err)
+				return
+			}
+			errs <- nil
+		}(peer)
+	}
+
+	var failed []error
+	for range peers {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+func (t *FaultyTransport) track(peer Peer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.peers[peer] = struct{}{}
+}
+
+func (t *FaultyTransport) untrack(peer Peer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.peers, peer)
+}
+
+// a duplicated incoming message runs handler twice. Drops and delays are
+// injected once, by the sending side, see faultyPeer.Request.
+func (t *FaultyTransport) Handle(msgType string, handler HandlerFunc) {
+	t.inner.Handle(msgType, func(peer Peer, msg Message) (Message, error) {
+		if t.chaos.duplicate() {
+			handler(peer, msg)
+		}
+		return handler(peer, msg)
+	})
+}
+
+func (t *FaultyTransport) OnPeerConnected(fn PeerFunc) {
+	t.inner.OnPeerConnected(fn)
+}
+
+func (t *FaultyTransport) OnPeerDisconnected(fn PeerFunc) {
+	t.inner.OnPeerDisconnected(fn)
+}
+
+func (t *FaultyTransport) Close() error {
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+	return t.inner.Close()
+}
+
+type faultyPeer struct {
+	Peer
+	chaos  *Chaos
+	local  string
+	remote string
+
+	lock   sync.Mutex
+	closed bool
+	// delayed sends still to be written, Close waits for them so the inner
+	// peer isn't written to once it is back in a pool
+	sends sync.WaitGroup
+}
+
+// sends asynchronously once the injected delay has passed, so a lost or
+// late message looks the same to the caller as it would on a real network.
+// A partition or a closed peer fails right away.
+func (p *faultyPeer) Send(msg Message) error {
+	if p.chaos.partitioned(p.local, p.remote) {
+		return fmt.Errorf("send to %s: %w", p.remote, ErrUnreachable)
+	}
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrPeerClosed
+	}
+	p.sends.Add(1)
+	p.lock.Unlock()
+
+	f := p.chaos.decide(p.local, p.remote)
+	if f.drop {
+		p.sends.Done()
+		return nil
+	}
+	go func() {
+		defer p.sends.Done()
+		sendWithFate(p.Peer, f, msg)
+	}()
+	return nil
+}
+
+// waits for pending delayed sends before releasing the inner peer
+func (p *faultyPeer) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.lock.Unlock()
+
+	p.sends.Wait()
+	return p.Peer.Close()
+}
+
+// writes msg to peer once f's delay has passed, twice if f duplicates it
+func sendWithFate(peer Peer, f fate, msg Message) error {
+	time.Sleep(f.delay)
+	if err := peer.Send(msg); err != nil {
+		return err
+	}
+	if f.duplicate {
+		return peer.Send(msg)
+	}
+	return nil
+}
+
+// faults the request on its way out and the reply on its way back, a lost
+// request or reply leaves the caller waiting for ctx. Duplicates are injected
+// on the serving side, see FaultyTransport.Handle.
+func (p *faultyPeer) Request(ctx context.Context, msg Message) (Message, error) {
+	p.lock.Lock()
+	closed := p.closed
+	p.lock.Unlock()
+	if closed {
+		return Message{}, ErrPeerClosed
+	}
+	if err := p.fault(ctx, p.chaos.decide(p.local, p.remote)); err != nil {
+		return Message{}, err
+	}
+	resp, err := p.Peer.Request(ctx, msg)
+	if err != nil {
+		return resp, err
+	}
+	if err := p.fault(ctx, p.chaos.decide(p.remote, p.local)); err != nil {
+		return Message{}, err
+	}
+	return resp, nil
+}
+
+// waits out f's delay, or until ctx is done when f drops the message
+func (p *faultyPeer) fault(ctx context.Context, f fate) error {
+	if f.drop {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *faultyPeer) Receive() (Message, error) {
+	for {
+		msg, err := p.Peer.Receive()
+		if err != nil {
+			return msg, err
+		}
+		if f := p.chaos.decide(p.remote, p.local); !f.drop {
+			time.Sleep(f.delay)
+			return msg, nil
+		}
+	}
+}
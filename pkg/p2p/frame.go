@@ -0,0 +1,83 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// wire framing for messages exchanged between peers
+//
+//	+---------+------+----------------+------------------+
+//	| version | kind | length (u32be) | body (length) ...|
+//	+---------+------+----------------+------------------+
+const (
+	frameVersion    = 1
+	frameHeaderSize = 6
+
+	// upper bound on a single frame body, guards against corrupt or hostile length fields
+	MaxFrameSize = 64 << 20
+)
+
+type frameKind uint8
+
+const (
+	frameMessage frameKind = 1
+	frameHello   frameKind = 2
+)
+
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds maximum size")
+	ErrUnsupportedVersion = errors.New("unsupported frame version")
+)
+
+type frame struct {
+	kind frameKind
+	body []byte
+}
+
+// writes a single frame, header and body go out in one Write call
+func writeFrame(w io.Writer, kind frameKind, body []byte) error {
+	if len(body) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, frameHeaderSize+len(body))
+	buf[0] = frameVersion
+	buf[1] = byte(kind)
+	binary.BigEndian.PutUint32(buf[2:frameHeaderSize], uint32(len(body)))
+	copy(buf[frameHeaderSize:], body)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// reads a single frame, r must be the connection's long-lived reader so that
+// bytes buffered past the current frame are kept for the next call
+func readFrame(r *bufio.Reader) (frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+
+	if header[0] != frameVersion {
+		return frame{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > MaxFrameSize {
+		return frame{}, ErrFrameTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, err
+	}
+
+	return frame{kind: frameKind(header[1]), body: body}, nil
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// message types used for keepalives, answered by the transport itself and
+// never passed to registered handlers
+const (
+	MessageTypePing = "ping"
+	MessageTypePong = "pong"
+)
+
+const (
+	DefaultHeartbeatInterval = 5 * time.Second
+	DefaultHeartbeatTimeout  = 15 * time.Second
+)
+
+// callbacks fired as connections come and go
+type PeerFunc func(peer Peer)
+
+// the connection lifecycle subscribers of a transport
+type peerEvents struct {
+	lock         sync.RWMutex
+	connected    []PeerFunc
+	disconnected []PeerFunc
+}
+
+func (e *peerEvents) onConnected(fn PeerFunc) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.connected = append(e.connected, fn)
+}
+
+func (e *peerEvents) onDisconnected(fn PeerFunc) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.disconnected = append(e.disconnected, fn)
+}
+
+func (e *peerEvents) fire(peer Peer, up bool) {
+	e.lock.RLock()
+	fns := e.disconnected
+	if up {
+		fns = e.connected
+	}
+	fns = append([]PeerFunc(nil), fns...)
+	e.lock.RUnlock()
+
+	for _, fn := range fns {
+		fn(peer)
+	}
+}
+
+// reports peer as connected, pings it every interval until done is closed and
+// then reports it as disconnected. A peer that leaves a ping unanswered for
+// longer than timeout is closed, which ends the connection like a read error.
+func (e *peerEvents) watch(peer Peer, interval, timeout time.Duration, done <-chan struct{}) {
+	e.fire(peer, true)
+	defer e.fire(peer, false)
+
+	if interval <= 0 {
+		<-done
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := peer.Request(ctx, Message{Type: MessageTypePing})
+		cancel()
+		if err != nil {
+			select {
+			case <-done:
+				// closed while we were waiting, not a missed heartbeat
+				return
+			default:
+			}
+			log.Printf("Evicting unresponsive peer %s: %v", peer.RemoteAddr(), err)
+			peer.Close()
+			<-done
+			return
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrUnreachable = errors.New("address unreachable")
+
+var (
+	_ Transport = (*MemTransport)(nil)
+	_ Peer      = (*MemPeer)(nil)
+)
+
+// an in-process network shared by MemTransports, nodes on it talk through
+// channels instead of sockets and can be taken down or partitioned at will
+type MemNetwork struct {
+	lock       sync.Mutex
+	transports map[string]*MemTransport
+	down       map[string]bool
+	partitions map[[2]string]bool
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		transports: make(map[string]*MemTransport),
+		down:       make(map[string]bool),
+		partitions: make(map[[2]string]bool),
+	}
+}
+
+type MemOption func(*MemTransport)
+
+// pings every connection each interval and closes those that don't answer
+// within timeout, keepalives are off unless this is given
+func WithMemHeartbeat(interval, timeout time.Duration) MemOption {
+	return func(t *MemTransport) {
+		t.heartbeatInterval = interval
+		t.heartbeatTimeout = timeout
+	}
+}
+
+// creates a transport for address, it is reachable by other transports on
+// the network right away without waiting for ListenAndAccept
+func (n *MemNetwork) NewTransport(address string, opts ...MemOption) *MemTransport {
+	t := &MemTransport{
+		network:  n,
+		address:  address,
+		peers:    make(map[*MemPeer]struct{}),
+		handlers: make(map[string]HandlerFunc),
+		closed:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	n.lock.Lock()
+	n.transports[address] = t
+	n.lock.Unlock()
+	return t
+}
+
+// makes address unreachable and drops every connection it has, like a crash
+func (n *MemNetwork) Down(address string) {
+	n.lock.Lock()
+	n.down[address] = true
+	t := n.transports[address]
+	n.lock.Unlock()
+
+	if t != nil {
+		t.closePeers()
+	}
+}
+
+// makes address reachable again after Down
+func (n *MemNetwork) Up(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.down, address)
+}
+
+// cuts traffic between a and b in both directions until Heal is called
+func (n *MemNetwork) Partition(a, b string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions[pairKey(a, b)] = true
+}
+
+func (n *MemNetwork) Heal(a, b string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.partitions, pairKey(a, b))
+}
+
+// removes every partition and brings every address back up
+func (n *MemNetwork) HealAll() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions = make(map[[2]string]bool)
+	n.down = make(map[string]bool)
+}
+
+func pairKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+func (n *MemNetwork) reachable(from, to string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return !n.down[from] && !n.down[to] && !n.partitions[pairKey(from, to)]
+}
+
+func (n *MemNetwork) lookup(address string) *MemTransport {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.transports[address]
+}
+
+func (n *MemNetwork) remove(t *MemTransport) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.transports[t.address] == t {
+		delete(n.transports, t.address)
+	}
+}
+
+type MemTransport struct {
+	network *MemNetwork
+	address string
+
+	lock  sync.Mutex
+	peers map[*MemPeer]struct{}
+
+	handlersLock sync.RWMutex
+	handlers     map[string]HandlerFunc
+
+	events            peerEvents
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *MemTransport) Addr() string {
+	return t.address
+}
+
+// the transport accepts connections from creation, this only blocks until Close
+func (t *MemTransport) ListenAndAccept() error {
+	<-t.closed
+	return nil
+}
+
+func (t *MemTransport) Dial(address string) (Peer, error) {
+	if t.isClosed() {
+		return nil, ErrTransportClosed
+	}
+
+	remote := t.network.lookup(address)
+	if remote == nil || remote.isClosed() || !t.network.reachable(t.address, address) {
+		return nil, fmt.Errorf("dial %s: %w", address, ErrUnreachable)
+	}
+
+	local, other := newMemPipe(t, remote)
+	if !t.track(local) {
+		return nil, ErrTransportClosed
+	}
+	if !remote.track(other) {
+		t.untrack(local)
+		return nil, fmt.Errorf("dial %s: %w", address, ErrUnreachable)
+	}
+
+	go t.events.watch(local, t.heartbeatInterval, t.heartbeatTimeout, local.closed)
+	go remote.events.watch(other, remote.heartbeatInterval, remote.heartbeatTimeout, other.closed)
+	return local, nil
+}
+
+func (t *MemTransport) OnPeerConnected(fn PeerFunc) {
+	t.events.onConnected(fn)
+}
+
+func (t *MemTransport) OnPeerDisconnected(fn PeerFunc) {
+	t.events.onDisconnected(fn)
+}
+
+func (t *MemTransport) Handle(msgType string, handler HandlerFunc) {
+	t.handlersLock.Lock()
+	defer t.handlersLock.Unlock()
+	t.handlers[msgType] = handler
+}
+
+func (t *MemTransport) handler(msgType string) (HandlerFunc, bool) {
+	t.handlersLock.RLock()
+	defer t.handlersLock.RUnlock()
+	h, ok := t.handlers[msgType]
+	return h, ok
+}
+
+func (t *MemTransport) Broadcast(payload []byte) error {
+	msg := Message{Type: MessageTypeBroadcast, Payload: payload}
+	if t.isClosed() {
+		return ErrTransportClosed
+	}
+
+	t.lock.Lock()
+	peers := make([]*MemPeer, 0, len(t.peers))
+	for p := range t.peers {
+		peers = append(peers, p)
+	}
+	t.lock.Unlock()
+
+	var errs []error
+	for _, p := range peers {
+		if err := p.Send(msg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.remoteAddr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *MemTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.network.remove(t)
+		t.closePeers()
+	})
+	return nil
+}
+
+func (t *MemTransport) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *MemTransport) track(p *MemPeer) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.isClosed() {
+		return false
+	}
+	t.peers[p] = struct{}{}
+	return true
+}
+
+func (t *MemTransport) untrack(p *MemPeer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.peers, p)
+}
+
+func (t *MemTransport) closePeers() {
+	t.lock.Lock()
+	peers := t.peers
+	t.peers = make(map[*MemPeer]struct{})
+	t.lock.Unlock()
+
+	for p := range peers {
+		p.Close()
+	}
+}
+
+// one end of an in-memory connection
+type MemPeer struct {
+	transport  *MemTransport
+	localAddr  string
+	remoteAddr string
+	remote     *MemPeer
+
+	pendingLock sync.Mutex
+	pending     map[string]chan Message
+
+	inbox chan Message
+	// handlers of one-way messages, run in the order they were sent by this
+	// end's own goroutine rather than the sender's
+	ordered chan func()
+	// shared by both ends, closing either end closes the connection
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func newMemPipe(local, remote *MemTransport) (*MemPeer, *MemPeer) {
+	closed := make(chan struct{})
+	once := &sync.Once{}
+	a := &MemPeer{
+		transport:  local,
+		localAddr:  local.address,
+		remoteAddr: remote.address,
+		pending:    make(map[string]chan Message),
+		inbox:      make(chan Message, inboxSize),
+		ordered:    make(chan func(), inboxSize),
+		closed:     closed,
+		closeOnce:  once,
+	}
+	b := &MemPeer{
+		transport:  remote,
+		localAddr:  remote.address,
+		remoteAddr: local.address,
+		pending:    make(map[string]chan Message),
+		inbox:      make(chan Message, inboxSize),
+		ordered:    make(chan func(), inboxSize),
+		closed:     closed,
+		closeOnce:  once,
+	}
+	a.remote, b.remote = b, a
+	go a.runOrdered()
+	go b.runOrdered()
+	return a, b
+}
+
+// runs queued handlers until the connection is closed
+func (p *MemPeer) runOrdered() {
+	for {
+		select {
+		case fn := <-p.ordered:
+			fn()
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *MemPeer) LocalAddr() string {
+	return p.localAddr
+}
+
+func (p *MemPeer) RemoteAddr() string {
+	return p.remoteAddr
+}
+
+func (p *MemPeer) Send(msg Message) error {
+	select {
+	case <-p.closed:
+		return ErrPeerClosed
+	default:
+	}
+	if !p.transport.network.reachable(p.localAddr, p.remoteAddr) {
+		return fmt.Errorf("send to %s: %w", p.remoteAddr, ErrUnreachable)
+	}
+
+	if msg.Sender == "" {
+		msg.Sender = p.localAddr
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixNano()
+	}
+	// the receiver must not share the sender's buffer
+	if msg.Payload != nil {
+		msg.Payload = append([]byte(nil), msg.Payload...)
+	}
+
+	return p.remote.deliver(msg)
+}
+
+// hands msg to a waiting request, a handler or the inbox, in that order
+func (p *MemPeer) deliver(msg Message) error {
+	if msg.Type == MessageTypePing {
+		go p.Send(Message{ID: msg.ID, Type: MessageTypePong})
+		return nil
+	}
+
+	if msg.ID != "" {
+		p.pendingLock.Lock()
+		ch, ok := p.pending[msg.ID]
+		delete(p.pending, msg.ID)
+		p.pendingLock.Unlock()
+		if ok {
+			ch <- msg
+			return nil
+		}
+	}
+	if msg.Type == MessageTypePong {
+		// answer to a ping that already timed out
+		return nil
+	}
+
+	if handler, ok := p.transport.handler(msg.Type); ok {
+		handle := func() {
+			reply, err := handler(p, msg)
+			if err != nil {
+				log.Printf("Handler for %q from %s failed: %v", msg.Type, p.remoteAddr, err)
+				reply = Message{Type: MessageTypeError, Payload: []byte(err.Error())}
+			}
+			if reply.Type == "" {
+				return
+			}
+			reply.ID = msg.ID
+			if err := p.Send(reply); err != nil {
+				log.Printf("Failed to reply to %s: %v", p.remoteAddr, err)
+			}
+		}
+		// like TCPTransport, requests are handled concurrently and one-way
+		// messages in the order they were sent
+		if msg.ID != "" {
+			go handle()
+			return nil
+		}
+		select {
+		case p.ordered <- handle:
+			return nil
+		case <-p.closed:
+			return ErrPeerClosed
+		}
+	}
+
+	select {
+	case p.inbox <- msg:
+		return nil
+	case <-p.closed:
+		return ErrPeerClosed
+	}
+}
+
+func (p *MemPeer) Receive() (Message, error) {
+	select {
+	case msg := <-p.inbox:
+		return msg, nil
+	case <-p.closed:
+		select {
+		case msg := <-p.inbox:
+			return msg, nil
+		default:
+			return Message{}, io.EOF
+		}
+	}
+}
+
+func (p *MemPeer) Request(ctx context.Context, msg Message) (Message, error) {
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+
+	ch := make(chan Message, 1)
+	p.pendingLock.Lock()
+	p.pending[msg.ID] = ch
+	p.pendingLock.Unlock()
+
+	defer func() {
+		p.pendingLock.Lock()
+		delete(p.pending, msg.ID)
+		p.pendingLock.Unlock()
+	}()
+
+	if err := p.Send(msg); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Type == MessageTypeError {
+			return resp, fmt.Errorf("%w: %s", ErrRemote, resp.Payload)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-p.closed:
+		return Message{}, ErrPeerClosed
+	}
+}
+
+func (p *MemPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	p.transport.untrack(p)
+	p.remote.transport.untrack(p.remote)
+	return nil
+}
@@ -1,13 +1,41 @@
 package p2p
 
-import "encoding/json"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
 
+var (
+	ErrMalformedMessage = errors.New("malformed message")
+	// the remote handler failed, the error text follows
+	ErrRemote = errors.New("remote error")
+	// the connection went away while a request was outstanding
+	ErrPeerClosed = errors.New("peer closed")
+)
+
+// returns a random identifier for request/response correlation
+func NewMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// encodes a message with the first of DefaultCodecs
 func SerializeMessage(msg Message) ([]byte, error) {
-    return json.Marshal(msg)
+	codec, err := GetCodec(DefaultCodecs[0])
+	if err != nil {
+		return nil, err
+	}
+	return codec.Marshal(msg)
 }
 
 func DeserializeMessage(data []byte) (Message, error) {
-    var msg Message
-    err := json.Unmarshal(data, &msg)
-    return msg, err
+	var msg Message
+	codec, err := GetCodec(DefaultCodecs[0])
+	if err != nil {
+		return msg, err
+	}
+	err = codec.Unmarshal(data, &msg)
+	return msg, err
 }
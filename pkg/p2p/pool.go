@@ -0,0 +1,279 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConnsPerAddr = 4
+	DefaultMaxConns        = 256
+	DefaultIdleTimeout     = 90 * time.Second
+
+	// how long Dial waits for a pooled connection to be released once a cap is hit
+	poolWaitTimeout = 5 * time.Second
+)
+
+var ErrPoolExhausted = errors.New("connection pool exhausted")
+
+// keeps outbound connections per address for reuse, a connection is handed
+// out to one caller at a time and goes back to the pool when that caller
+// closes it
+type connPool struct {
+	dial func(address string) (*TCPPeer, error)
+
+	maxPerAddr  int
+	maxTotal    int
+	idleTimeout time.Duration
+
+	lock  sync.Mutex
+	idle  map[string][]*idleConn
+	open  map[string]int
+	total int
+	// every connection the pool owns, idle or checked out
+	conns map[*TCPPeer]struct{}
+	// closed and replaced whenever a connection is released, wakes waiters
+	released chan struct{}
+	closed   bool
+	stop     chan struct{}
+}
+
+type idleConn struct {
+	peer  *TCPPeer
+	since time.Time
+}
+
+func newConnPool(dial func(address string) (*TCPPeer, error), maxPerAddr, maxTotal int, idleTimeout time.Duration) *connPool {
+	p := &connPool{
+		dial:        dial,
+		maxPerAddr:  maxPerAddr,
+		maxTotal:    maxTotal,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]*idleConn),
+		open:        make(map[string]int),
+		conns:       make(map[*TCPPeer]struct{}),
+		released:    make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.evictIdle()
+	}
+	return p
+}
+
+func (p *connPool) get(address string) (*pooledPeer, error) {
+	timeout := time.NewTimer(poolWaitTimeout)
+	defer timeout.Stop()
+
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, ErrTransportClosed
+		}
+
+		if peer := p.popIdle(address); peer != nil {
+			p.lock.Unlock()
+			return &pooledPeer{TCPPeer: peer, pool: p, address: address}, nil
+		}
+
+		if p.open[address] < p.maxPerAddr && p.total < p.maxTotal {
+			p.open[address]++
+			p.total++
+			p.lock.Unlock()
+
+			peer, err := p.dial(address)
+			p.lock.Lock()
+			// close resets the counters, so a reservation made before it is void
+			if err != nil {
+				if !p.closed {
+					p.forget(address, nil)
+				}
+				p.lock.Unlock()
+				return nil, err
+			}
+			if p.closed {
+				p.lock.Unlock()
+				peer.Close()
+				return nil, ErrTransportClosed
+			}
+			p.conns[peer] = struct{}{}
+			p.lock.Unlock()
+			return &pooledPeer{TCPPeer: peer, pool: p, address: address}, nil
+		}
+
+		released := p.released
+		p.lock.Unlock()
+
+		select {
+		case <-released:
+		case <-timeout.C:
+			return nil, ErrPoolExhausted
+		}
+	}
+}
+
+// returns the most recently used healthy idle connection, discarding dead ones
+func (p *connPool) popIdle(address string) *TCPPeer {
+	conns := p.idle[address]
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		p.idle[address] = conns
+
+		if healthy(c.peer) {
+			return c.peer
+		}
+		c.peer.Close()
+		p.forget(address, c.peer)
+	}
+	delete(p.idle, address)
+	return nil
+}
+
+// a connection can be reused if its read loop is alive and nothing unread
+// is waiting in its inbox for the previous user
+func healthy(peer *TCPPeer) bool {
+	select {
+	case <-peer.done:
+		return false
+	default:
+	}
+	return len(peer.inbox) == 0
+}
+
+// must be called with the lock held
+func (p *connPool) forget(address string, peer *TCPPeer) {
+	delete(p.conns, peer)
+	p.open[address]--
+	if p.open[address] <= 0 {
+		delete(p.open, address)
+	}
+	p.total--
+	p.wake()
+}
+
+// must be called with the lock held
+func (p *connPool) wake() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+func (p *connPool) put(address string, peer *TCPPeer, broken bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.conns[peer]; !ok {
+		// already closed and forgotten by close
+		return
+	}
+	if broken || p.closed || !healthy(peer) {
+		peer.Close()
+		p.forget(address, peer)
+		return
+	}
+
+	p.idle[address] = append(p.idle[address], &idleConn{peer: peer, since: time.Now()})
+	p.wake()
+}
+
+func (p *connPool) evictIdle() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-p.idleTimeout)
+		p.lock.Lock()
+		for address, conns := range p.idle {
+			kept := conns[:0]
+			for _, c := range conns {
+				if c.since.Before(cutoff) || !healthy(c.peer) {
+					c.peer.Close()
+					p.forget(address, c.peer)
+					continue
+				}
+				kept = append(kept, c)
+			}
+			if len(kept) == 0 {
+				delete(p.idle, address)
+			} else {
+				p.idle[address] = kept
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// closes every connection, including ones that are checked out
+func (p *connPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.stop)
+
+	for peer := range p.conns {
+		peer.Close()
+	}
+	p.conns = make(map[*TCPPeer]struct{})
+	p.idle = make(map[string][]*idleConn)
+	p.open = make(map[string]int)
+	p.total = 0
+	p.wake()
+}
+
+// a connection checked out of the pool, Close hands it back instead of
+// closing the socket
+type pooledPeer struct {
+	*TCPPeer
+	pool    *connPool
+	address string
+
+	lock     sync.Mutex
+	broken   bool
+	released bool
+}
+
+func (p *pooledPeer) Send(msg Message) error {
+	err := p.TCPPeer.Send(msg)
+	p.fail(err)
+	return err
+}
+
+func (p *pooledPeer) Request(ctx context.Context, msg Message) (Message, error) {
+	resp, err := p.TCPPeer.Request(ctx, msg)
+	p.fail(err)
+	return resp, err
+}
+
+// marks the connection unfit for reuse, a late response to a timed out
+// request would otherwise reach the next caller
+func (p *pooledPeer) fail(err error) {
+	if err == nil || errors.Is(err, ErrRemote) {
+		return
+	}
+	p.lock.Lock()
+	p.broken = true
+	p.lock.Unlock()
+}
+
+func (p *pooledPeer) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.released {
+		return nil
+	}
+	p.released = true
+	p.pool.put(p.address, p.TCPPeer, p.broken)
+	return nil
+}
@@ -0,0 +1,406 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// how many unsolicited messages are buffered for Receive before the read loop blocks
+const inboxSize = 64
+
+type TCPPeer struct {
+	conn      net.Conn
+	outbound  bool
+	codec     Codec
+	localAddr string
+	// the remote node's advertised address, learned during the handshake
+	remoteNode string
+
+	// persistent per connection so buffered bytes survive across reads
+	reader *bufio.Reader
+	// serializes frame writes from concurrent senders
+	writeLock sync.Mutex
+
+	// requests waiting for a response with the same ID
+	pendingLock sync.Mutex
+	pending     map[string]chan Message
+
+	// messages that are neither responses nor handled by the transport
+	inbox chan Message
+	// set by the transport, reports whether it took care of msg
+	dispatch func(msg Message) bool
+	// work the transport queues for one-way messages, run in arrival order
+	// by a goroutine of its own so the read loop never waits on a handler
+	ordered chan func()
+
+	// closed once the read loop exits, err holds the reason
+	done      chan struct{}
+	err       error
+	startOnce sync.Once
+
+	// closed by Close so a read loop stuck on a full inbox can exit
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// wraps conn using the default codec, no negotiation takes place
+func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
+	p := newTCPPeer(conn, outbound, conn.LocalAddr().String())
+	p.start(nil)
+	return p
+}
+
+func newTCPPeer(conn net.Conn, outbound bool, localAddr string) *TCPPeer {
+	codec, _ := GetCodec(DefaultCodecs[0])
+	return &TCPPeer{
+		conn:      conn,
+		outbound:  outbound,
+		codec:     codec,
+		localAddr: localAddr,
+		reader:    bufio.NewReader(conn),
+		pending:   make(map[string]chan Message),
+		inbox:     make(chan Message, inboxSize),
+		ordered:   make(chan func(), inboxSize),
+		done:      make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+}
+
+// starts the read loop, must only be called once the handshake is complete
+func (p *TCPPeer) start(dispatch func(msg Message) bool) {
+	p.startOnce.Do(func() {
+		p.dispatch = dispatch
+		go p.readLoop()
+		go p.runOrdered()
+	})
+}
+
+// runs queued work until the read loop exits and the queue is drained
+func (p *TCPPeer) runOrdered() {
+	for fn := range p.ordered {
+		fn()
+	}
+}
+
+// queues fn behind earlier work, false if the peer was closed first. Only
+// the read loop may call it.
+func (p *TCPPeer) enqueue(fn func()) bool {
+	select {
+	case p.ordered <- fn:
+		return true
+	case <-p.closed:
+		return false
+	}
+}
+
+func (p *TCPPeer) readLoop() {
+	var err error
+	defer func() {
+		p.err = err
+		close(p.ordered)
+		close(p.done)
+	}()
+
+	for {
+		var msg Message
+		msg, err = p.readMessage()
+		if err != nil {
+			return
+		}
+
+		if p.resolve(msg) {
+			continue
+		}
+		if p.dispatch != nil && p.dispatch(msg) {
+			continue
+		}
+
+		select {
+		case p.inbox <- msg:
+		case <-p.closed:
+			err = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (p *TCPPeer) readMessage() (Message, error) {
+	for {
+		f, err := readFrame(p.reader)
+		if err != nil {
+			return Message{}, err
+		}
+
+		if f.kind != frameMessage {
+			log.Printf("Skipping unexpected frame kind %d from %s", f.kind, p.conn.RemoteAddr())
+			continue
+		}
+
+		var msg Message
+		err = p.codec.Unmarshal(f.body, &msg)
+		return msg, err
+	}
+}
+
+// hands msg to the request waiting on its ID, if any
+func (p *TCPPeer) resolve(msg Message) bool {
+	if msg.ID == "" {
+		return false
+	}
+
+	p.pendingLock.Lock()
+	ch, ok := p.pending[msg.ID]
+	delete(p.pending, msg.ID)
+	p.pendingLock.Unlock()
+
+	if ok {
+		ch <- msg
+	}
+	return ok
+}
+
+func (p *TCPPeer) Send(msg Message) error {
+	if msg.Sender == "" {
+		msg.Sender = p.localAddr
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixNano()
+	}
+
+	body, err := p.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	return writeFrame(p.conn, frameMessage, body)
+}
+
+// returns the next message that is neither a response to a Request nor
+// served by a transport handler
+func (p *TCPPeer) Receive() (Message, error) {
+	select {
+	case msg := <-p.inbox:
+		return msg, nil
+	case <-p.done:
+		// drain anything that arrived before the connection went away
+		select {
+		case msg := <-p.inbox:
+			return msg, nil
+		default:
+			return Message{}, p.err
+		}
+	}
+}
+
+// sends msg and waits for the response carrying the same ID, any number of
+// requests may be outstanding on the connection at once
+func (p *TCPPeer) Request(ctx context.Context, msg Message) (Message, error) {
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+
+	ch := make(chan Message, 1)
+	p.pendingLock.Lock()
+	p.pending[msg.ID] = ch
+	p.pendingLock.Unlock()
+
+	defer func() {
+		p.pendingLock.Lock()
+		delete(p.pending, msg.ID)
+		p.pendingLock.Unlock()
+	}()
+
+	if err := p.Send(msg); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Type == MessageTypeError {
+			return resp, fmt.Errorf("%w: %s", ErrRemote, resp.Payload)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-p.done:
+		if errors.Is(p.err, net.ErrClosed) {
+			return Message{}, ErrPeerClosed
+		}
+		return Message{}, fmt.Errorf("%w: %v", ErrPeerClosed, p.err)
+	}
+}
+
+// waits for any frame being written to finish before closing the connection
+func (p *TCPPeer) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+
+	// closing the conn first fails a write stuck on it instead of waiting
+	// behind it, the lock then waits for that write to return
+	err := p.conn.Close()
+	p.writeLock.Lock()
+	p.writeLock.Unlock()
+	return err
+}
+
+func (p *TCPPeer) LocalAddr() string {
+	return p.conn.LocalAddr().String()
+}
+
+// the address the remote node listens on when it advertised one, otherwise
+// the socket address of the connection
+func (p *TCPPeer) RemoteAddr() string {
+	if p.remoteNode != "" {
+		return p.remoteNode
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// the name of the codec in use on this connection
+func (p *TCPPeer) Codec() string {
+	return p.codec.Name()
+}
+
+const handshakeTimeout = 10 * time.Second
+
+// first frame on every connection, the dialer offers codecs in order of
+// preference and the listener answers with the single codec it picked. Both
+// sides advertise the address they accept connections on.
+type hello struct {
+	Codecs []string `json:"codecs"`
+	Addr   string   `json:"addr,omitempty"`
+}
+
+func (p *TCPPeer) writeHello(h hello) error {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	return writeFrame(p.conn, frameHello, body)
+}
+
+func (p *TCPPeer) readHello() (hello, error) {
+	var h hello
+	f, err := readFrame(p.reader)
+	if err != nil {
+		return h, err
+	}
+	if f.kind != frameHello {
+		return h, fmt.Errorf("expected hello frame, got kind %d", f.kind)
+	}
+	err = json.Unmarshal(f.body, &h)
+	return h, err
+}
+
+// completes the TLS handshake up front so the peer's identity is known
+// before any message is exchanged, a no-op on plain connections
+func (p *TCPPeer) handshakeTLS() error {
+	conn, ok := p.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake: %v", err)
+	}
+	return nil
+}
+
+// the certificate the remote node presented, nil on plain connections or
+// when the remote side sent none
+func (p *TCPPeer) PeerCertificate() *x509.Certificate {
+	conn, ok := p.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// the remote node's identity taken from its verified certificate, the common
+// name or else the first DNS name, empty without TLS
+func (p *TCPPeer) Identity() string {
+	cert := p.PeerCertificate()
+	if cert == nil {
+		return ""
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// runs the dialer side of the handshake, TLS first and then codec negotiation
+func (p *TCPPeer) clientHandshake(codecs []string) error {
+	p.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer p.conn.SetDeadline(time.Time{})
+
+	if err := p.handshakeTLS(); err != nil {
+		return err
+	}
+	if err := p.writeHello(hello{Codecs: codecs, Addr: p.localAddr}); err != nil {
+		return fmt.Errorf("send hello: %v", err)
+	}
+
+	resp, err := p.readHello()
+	if err != nil {
+		return fmt.Errorf("read hello: %v", err)
+	}
+	if len(resp.Codecs) != 1 {
+		return fmt.Errorf("peer %s did not agree on a codec", p.conn.RemoteAddr())
+	}
+
+	codec, err := negotiateCodec(resp.Codecs, codecs)
+	if err != nil {
+		return err
+	}
+	p.codec = codec
+	return nil
+}
+
+// runs the listener side of the handshake, TLS first and then codec negotiation
+func (p *TCPPeer) serverHandshake(codecs []string) error {
+	p.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer p.conn.SetDeadline(time.Time{})
+
+	if err := p.handshakeTLS(); err != nil {
+		return err
+	}
+	req, err := p.readHello()
+	if err != nil {
+		return fmt.Errorf("read hello: %v", err)
+	}
+
+	p.remoteNode = req.Addr
+
+	codec, err := negotiateCodec(req.Codecs, codecs)
+	if err != nil {
+		// answer anyway so the dialer fails fast instead of hanging
+		p.writeHello(hello{Addr: p.localAddr})
+		return err
+	}
+
+	if err := p.writeHello(hello{Codecs: []string{codec.Name()}, Addr: p.localAddr}); err != nil {
+		return fmt.Errorf("send hello: %v", err)
+	}
+	p.codec = codec
+	return nil
+}
@@ -1,103 +1,456 @@
 package p2p
 
 import (
-	"bufio"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
-type TCPPeer struct {
-	conn     net.Conn
-	outbound bool
+var ErrTransportClosed = errors.New("transport closed")
+
+var (
+	_ Transport = (*TCPTransport)(nil)
+	_ Peer      = (*TCPPeer)(nil)
+	_ Peer      = (*pooledPeer)(nil)
+)
+
+type TCPTransport struct {
+	address  string
+	listener net.Listener
+	peers    map[string]Peer
+	lock     sync.Mutex
+	codecs   []string
+
+	tlsConfig *tls.Config
+
+	pool            *connPool
+	maxConnsPerAddr int
+	maxConns        int
+	idleTimeout     time.Duration
+
+	handlersLock sync.RWMutex
+	handlers     map[string]HandlerFunc
+
+	events            peerEvents
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	closed bool
+	// in-flight broadcasts and handler replies, drained by Close before peers are closed
+	sends sync.WaitGroup
+	// running connection handlers
+	conns sync.WaitGroup
 }
 
-func (p *TCPPeer) Send(msg Message) error {
-	encoder := json.NewEncoder(p.conn)
-	return encoder.Encode(msg)
+type TCPOption func(*TCPTransport)
+
+// sets the codecs this transport is willing to speak, most preferred first
+func WithCodecs(names ...string) TCPOption {
+	return func(t *TCPTransport) {
+		t.codecs = names
+	}
 }
 
-func (p *TCPPeer) Receive() (Message, error) {
-	decoder := json.NewDecoder(bufio.NewReader(p.conn))
-	var msg Message
-	err := decoder.Decode(&msg)
-	return msg, err
+// secures every connection with TLS, for mutual TLS the config must carry
+// our certificate along with RootCAs, ClientCAs and a ClientAuth policy
+func WithTLSConfig(cfg *tls.Config) TCPOption {
+	return func(t *TCPTransport) {
+		t.tlsConfig = cfg
+	}
 }
 
-func (p *TCPPeer) Close() error {
-	return p.conn.Close()
+// pings every connection each interval and closes those that don't answer
+// within timeout, a zero interval turns keepalives off
+func WithHeartbeat(interval, timeout time.Duration) TCPOption {
+	return func(t *TCPTransport) {
+		t.heartbeatInterval = interval
+		t.heartbeatTimeout = timeout
+	}
 }
 
-type TCPTransport struct {
-	address  string
-	listener net.Listener
-	peers    map[string]Peer
-	lock     sync.Mutex
+// caps the pooled outbound connections kept per remote address
+func WithMaxConnsPerAddr(n int) TCPOption {
+	return func(t *TCPTransport) {
+		t.maxConnsPerAddr = n
+	}
+}
+
+// caps the pooled outbound connections across all addresses
+func WithMaxConns(n int) TCPOption {
+	return func(t *TCPTransport) {
+		t.maxConns = n
+	}
+}
+
+// closes pooled connections that have been idle for longer than d, zero keeps them forever
+func WithIdleTimeout(d time.Duration) TCPOption {
+	return func(t *TCPTransport) {
+		t.idleTimeout = d
+	}
 }
 
-func NewTCPTransport(address string) *TCPTransport {
-	return &TCPTransport{
-		address: address,
-		peers:   make(map[string]Peer),
+func NewTCPTransport(address string, opts ...TCPOption) *TCPTransport {
+	t := &TCPTransport{
+		address:  address,
+		peers:    make(map[string]Peer),
+		codecs:   DefaultCodecs,
+		handlers: make(map[string]HandlerFunc),
+
+		heartbeatInterval: DefaultHeartbeatInterval,
+		heartbeatTimeout:  DefaultHeartbeatTimeout,
+
+		maxConnsPerAddr: DefaultMaxConnsPerAddr,
+		maxConns:        DefaultMaxConns,
+		idleTimeout:     DefaultIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.pool = newConnPool(t.dial, t.maxConnsPerAddr, t.maxConns, t.idleTimeout)
+	return t
+}
+
+// the address the transport is listening on, or the configured one before
+// ListenAndAccept has bound it
+func (t *TCPTransport) Addr() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listener != nil {
+		return t.listener.Addr().String()
 	}
+	return t.address
 }
 
 func (t *TCPTransport) ListenAndAccept() error {
-	var err error
-	t.listener, err = net.Listen("tcp", t.address)
+	listener, err := net.Listen("tcp", t.address)
 	if err != nil {
 		return err
 	}
+	if t.tlsConfig != nil {
+		listener = tls.NewListener(listener, t.tlsConfig)
+	}
 
-	fmt.Printf("Listening on %s\n", t.address)
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		listener.Close()
+		return ErrTransportClosed
+	}
+	t.listener = listener
+	t.lock.Unlock()
+
+	fmt.Printf("Listening on %s\n", listener.Addr())
 	for {
-		conn, err := t.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Printf("Accept error: %v\n", err)
 			continue
 		}
 
-		peer := &TCPPeer{conn: conn}
 		t.lock.Lock()
-		t.peers[conn.RemoteAddr().String()] = peer
+		if t.closed {
+			t.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		t.conns.Add(1)
 		t.lock.Unlock()
 
-		go t.handleConnection(peer)
+		go func() {
+			defer t.conns.Done()
+			t.handleConnection(newTCPPeer(conn, false, t.address))
+		}()
 	}
 }
 
+// hands out a pooled connection to address, dialing a new one if none is
+// idle. Closing the returned peer releases it back to the pool.
 func (t *TCPTransport) Dial(address string) (Peer, error) {
+	return t.pool.get(address)
+}
+
+// verifies the server against the host we dialed unless the config names one
+func clientTLSConfig(cfg *tls.Config, address string) *tls.Config {
+	if cfg.ServerName != "" || cfg.InsecureSkipVerify {
+		return cfg
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	cfg = cfg.Clone()
+	cfg.ServerName = host
+	return cfg
+}
+
+func (t *TCPTransport) dial(address string) (*TCPPeer, error) {
+	t.lock.Lock()
+	closed := t.closed
+	t.lock.Unlock()
+	if closed {
+		return nil, ErrTransportClosed
+	}
+
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
+	if t.tlsConfig != nil {
+		conn = tls.Client(conn, clientTLSConfig(t.tlsConfig, address))
+	}
+
+	peer := newTCPPeer(conn, true, t.address)
+	peer.remoteNode = address
+	if err := peer.clientHandshake(t.codecs); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s: %v", address, err)
+	}
 
-	peer := &TCPPeer{conn: conn, outbound: true}
 	t.lock.Lock()
-	t.peers[address] = peer
-	t.lock.Unlock()
+	defer t.lock.Unlock()
+	if t.closed {
+		peer.Close()
+		return nil, ErrTransportClosed
+	}
+	if _, ok := t.peers[address]; !ok {
+		t.peers[address] = peer
+	}
+
+	// messages without a handler are left for the caller's Receive
+	peer.start(func(msg Message) bool {
+		return t.dispatch(peer, address, msg, false)
+	})
+
+	go func() {
+		t.events.watch(peer, t.heartbeatInterval, t.heartbeatTimeout, peer.done)
+		t.lock.Lock()
+		if t.peers[address] == Peer(peer) {
+			delete(t.peers, address)
+		}
+		t.lock.Unlock()
+	}()
 
 	return peer, nil
 }
 
+// subscribes fn to every connection that completes its handshake, inbound or outbound
+func (t *TCPTransport) OnPeerConnected(fn PeerFunc) {
+	t.events.onConnected(fn)
+}
+
+// subscribes fn to every connection that closes, fails or stops answering heartbeats
+func (t *TCPTransport) OnPeerDisconnected(fn PeerFunc) {
+	t.events.onDisconnected(fn)
+}
+
+// registers the handler for messages of msgType, replacing any previous one
+func (t *TCPTransport) Handle(msgType string, handler HandlerFunc) {
+	t.handlersLock.Lock()
+	defer t.handlersLock.Unlock()
+	t.handlers[msgType] = handler
+}
+
+// runs the handler registered for msg.Type in its own goroutine, so slow
+// handlers don't hold up responses to our own requests on the same connection.
+// One-way messages, which carry no ID to match replies by, are handled one at
+// a time in the order they arrived, queued on the connection.
+// Unhandled messages are logged when logUnhandled is set, otherwise reported
+// back to the caller as not dispatched.
+func (t *TCPTransport) dispatch(peer *TCPPeer, addr string, msg Message, logUnhandled bool) bool {
+	switch msg.Type {
+	case MessageTypePing:
+		t.track(func() {
+			peer.Send(Message{ID: msg.ID, Type: MessageTypePong})
+		})
+		return true
+	case MessageTypePong:
+		// answer to a ping that already timed out
+		return true
+	}
+
+	t.handlersLock.RLock()
+	handler, ok := t.handlers[msg.Type]
+	t.handlersLock.RUnlock()
+
+	if !ok {
+		if logUnhandled {
+			log.Printf("Received message from %s: %+v", addr, msg)
+		}
+		return logUnhandled
+	}
+
+	handle := func() {
+		reply, err := handler(peer, msg)
+		if err != nil {
+			log.Printf("Handler for %q from %s failed: %v", msg.Type, addr, err)
+			reply = Message{Type: MessageTypeError, Payload: []byte(err.Error())}
+		}
+		if reply.Type == "" {
+			return
+		}
+
+		reply.ID = msg.ID
+		if err := peer.Send(reply); err != nil {
+			log.Printf("Failed to reply to %s: %v", addr, err)
+		}
+	}
+	if msg.ID == "" {
+		t.trackOrdered(peer, handle)
+	} else {
+		t.track(handle)
+	}
+	return true
+}
+
+// runs fn in its own goroutine so that Close waits for it. Nothing runs once
+// the transport is closed.
+func (t *TCPTransport) track(fn func()) {
+	if !t.begin() {
+		return
+	}
+	go func() {
+		defer t.sends.Done()
+		fn()
+	}()
+}
+
+// like track but fn runs after the work queued on peer before it
+func (t *TCPTransport) trackOrdered(peer *TCPPeer, fn func()) {
+	if !t.begin() {
+		return
+	}
+	queued := peer.enqueue(func() {
+		defer t.sends.Done()
+		fn()
+	})
+	if !queued {
+		t.sends.Done()
+	}
+}
+
+// counts a send Close must wait for, false once the transport is closed
+func (t *TCPTransport) begin() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.sends.Add(1)
+	return true
+}
+
+// sends msg to every connected peer concurrently, failures are collected
+// per peer and returned together
+func (t *TCPTransport) Broadcast(payload []byte) error {
+	msg := Message{Type: MessageTypeBroadcast, Payload: payload}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return ErrTransportClosed
+	}
+	peers := make(map[string]Peer, len(t.peers))
+	for addr, peer := range t.peers {
+		peers[addr] = peer
+	}
+	t.sends.Add(1)
+	t.lock.Unlock()
+	defer t.sends.Done()
+
+	var (
+		errsLock sync.Mutex
+		errs     []error
+		wg       sync.WaitGroup
+	)
+	for addr, peer := range peers {
+		wg.Add(1)
+		go func(addr string, peer Peer) {
+			defer wg.Done()
+			if err := peer.Send(msg); err != nil {
+				errsLock.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+				errsLock.Unlock()
+			}
+		}(addr, peer)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// stops accepting connections, waits for in-flight broadcasts and handler
+// replies, then closes every peer
+func (t *TCPTransport) Close() error {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil
+	}
+	t.closed = true
+	listener := t.listener
+	t.lock.Unlock()
+
+	var errs []error
+	if listener != nil {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	t.sends.Wait()
+	t.pool.close()
+
+	t.lock.Lock()
+	peers := t.peers
+	t.peers = make(map[string]Peer)
+	t.lock.Unlock()
+
+	for addr, peer := range peers {
+		if err := peer.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		}
+	}
+
+	t.conns.Wait()
+	return errors.Join(errs...)
+}
+
 func (t *TCPTransport) handleConnection(peer *TCPPeer) {
+	defer peer.Close()
+
+	if err := peer.serverHandshake(t.codecs); err != nil {
+		log.Printf("Handshake with %s failed: %v", peer.conn.RemoteAddr(), err)
+		return
+	}
+
+	addr := peer.conn.RemoteAddr().String()
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.peers[addr] = peer
+	t.lock.Unlock()
+
 	defer func() {
 		t.lock.Lock()
-		delete(t.peers, peer.conn.RemoteAddr().String())
+		delete(t.peers, addr)
 		t.lock.Unlock()
-		peer.Close()
 	}()
 
-	for {
-		msg, err := peer.Receive()
-		if err != nil {
-			log.Printf("Error receiving message: %v", err)
-			return
-		}
+	peer.start(func(msg Message) bool {
+		return t.dispatch(peer, addr, msg, true)
+	})
 
-		log.Printf("Received message from %s: %+v",
-			peer.conn.RemoteAddr().String(), msg)
+	t.events.watch(peer, t.heartbeatInterval, t.heartbeatTimeout, peer.done)
+	if err := peer.err; err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+		log.Printf("Error receiving message: %v", err)
 	}
 }
@@ -1,25 +1,59 @@
 package p2p
 
+import "context"
+
 // handles communication between nodes in the network
 type Transport interface {
+	// the address other nodes reach this transport on
+	Addr() string
 	Dial(addr string) (Peer, error)
 	ListenAndAccept() error
-	Broadcast(msg []byte) error
+	// sends payload to every connected peer as a MessageTypeBroadcast message
+	Broadcast(payload []byte) error
+	Handle(msgType string, handler HandlerFunc)
+	OnPeerConnected(fn PeerFunc)
+	OnPeerDisconnected(fn PeerFunc)
 	Close() error
 }
 
+// serves a received message, a reply with a non-empty Type is written back
+// to the sender on the same connection
+type HandlerFunc func(peer Peer, msg Message) (Message, error)
+
+const (
+	// message type used to report handler failures back to the sender
+	MessageTypeError = "error"
+	// message type Broadcast sends, receivers Handle it like any other type
+	MessageTypeBroadcast = "broadcast"
+)
+
 // represents a remote node
 type Peer interface {
 	Send(msg Message) error
 	Receive() (Message, error)
+	Request(ctx context.Context, msg Message) (Message, error)
+	// the address of the node on the other end
+	RemoteAddr() string
 	Close() error
 }
 
+// the authenticated identity of the node behind peer, empty when the
+// connection is not secured with TLS
+func PeerIdentity(peer Peer) string {
+	if p, ok := peer.(interface{ Identity() string }); ok {
+		return p.Identity()
+	}
+	return ""
+}
+
 // represents a message that can be sent between nodes
 type Message struct {
-	// ID        string
+	// correlates a response with its request, empty for one-way messages
+	ID      string
 	Type    string
 	Payload []byte
-	// Sender    Peer
-	// Timestamp int64
+	// address of the sending node
+	Sender string
+	// unix nanoseconds at which the message was sent
+	Timestamp int64
 }
@@ -2,31 +2,36 @@ package main
 
 import (
     "log"
-    // "os"
-    // "os/signal"
-    // "syscall"
+    "os"
+    "os/signal"
+    "syscall"
 
-    // "github.com/abdealijaroli/godfs/config"
-    // "github.com/abdealijaroli/godfs/pkg/p2p"
+    "github.com/abdealijaroli/godfs/config"
+    "github.com/abdealijaroli/godfs/pkg/p2p"
 )
 
 func Serve() {
-    // tlsConfig, err := config.LoadTLSConfig("certs/server.crt", "certs/server.key", "certs/ca.crt")
-    // if err != nil {
-    //     log.Fatal("Failed to load TLS config:", err)
-    // }
+    tlsConfig, err := config.LoadTLSConfig("certs/server.crt", "certs/server.key", "certs/ca.crt")
+    if err != nil {
+        log.Fatal("Failed to load TLS config:", err)
+    }
 
-    // t := p2p.NewTCPTransport(":8080", tlsConfig)
+    t := p2p.NewTCPTransport(":8080", p2p.WithTLSConfig(tlsConfig))
+    t.Handle("greeting", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+        log.Printf("Greeting from %s: %s", p2p.PeerIdentity(peer), msg.Payload)
+        return p2p.Message{}, nil
+    })
 
-    // go func() {
-    //     if err := t.ListenAndAccept(); err != nil {
-    //         log.Printf("Transport error: %v", err)
-    //     }
-    // }()
+    go func() {
+        if err := t.ListenAndAccept(); err != nil {
+            log.Printf("Transport error: %v", err)
+        }
+    }()
 
-    // sigChan := make(chan os.Signal, 1)
-    // signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-    // <-sigChan
+    sigChan := make(chan os.Signal, 1)
+    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+    <-sigChan
 
     log.Println("Shutting down server...")
+    t.Close()
 }
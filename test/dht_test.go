@@ -1,54 +1,105 @@
 package node_test
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/abdealijaroli/godfs/internal/file"
 	"github.com/abdealijaroli/godfs/internal/node"
+	"github.com/abdealijaroli/godfs/pkg/p2p"
 )
 
-func loadTLSConfig() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair("../certs/server.crt", "../certs/server.key")
-	if err != nil {
-		return nil, err
-	}
+// starts one DHT per address on a shared in-memory network, each knowing all the others
+func newCluster(t *testing.T, addrs ...string) (*p2p.MemNetwork, []*node.DHT) {
+	t.Helper()
+	return startCluster(t, nil, nil, addrs...)
+}
 
-	caCert, err := os.ReadFile("../certs/ca.crt")
-	if err != nil {
-		return nil, err
-	}
+// like newCluster but every node's traffic goes through chaos
+func newChaosCluster(t *testing.T, chaos *p2p.Chaos, addrs ...string) []*node.DHT {
+	t.Helper()
+	t.Cleanup(chaos.Stop)
+	_, dhts := startCluster(t, chaos, nil, addrs...)
+	return dhts
+}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+// like newCluster but every node is created with opts, and its traffic goes
+// through chaos unless that is nil
+func startCluster(t *testing.T, chaos *p2p.Chaos, opts []node.Option, addrs ...string) (*p2p.MemNetwork, []*node.DHT) {
+	t.Helper()
+	network := p2p.NewMemNetwork()
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
+	dhts := make([]*node.DHT, len(addrs))
+	for i, addr := range addrs {
+		var transport p2p.Transport = network.NewTransport(addr)
+		nodeOpts := append([]node.Option{}, opts...)
+		if chaos != nil {
+			transport = chaos.Wrap(transport)
+			nodeOpts = append(nodeOpts, node.WithRequestTimeout(50*time.Millisecond))
+		}
+		dhts[i] = node.NewDHT(addr, append(nodeOpts, node.WithTransport(transport))...)
+		t.Cleanup(func() { dhts[i].Close() })
+	}
+	for _, d := range dhts {
+		for _, addr := range addrs {
+			d.AddNode(addr)
+		}
 	}
+	return network, dhts
+}
 
-	return tlsConfig, nil
+// the nodes of a cluster started with addrs, by address
+func byAddress(addrs []string, dhts []*node.DHT) map[string]*node.DHT {
+	out := make(map[string]*node.DHT, len(addrs))
+	for i, addr := range addrs {
+		out[addr] = dhts[i]
+	}
+	return out
 }
 
-func TestDHT(t *testing.T) {
-	_, err := loadTLSConfig()
-	if err != nil {
-		t.Fatalf("Failed to load TLS config: %v", err)
+// a node of cluster that isn't one of key's n owners
+func nonOwner(t *testing.T, cluster map[string]*node.DHT, key string, n int) *node.DHT {
+	t.Helper()
+	addrs := make([]string, 0, len(cluster))
+	for addr := range cluster {
+		addrs = append(addrs, addr)
 	}
+	sort.Strings(addrs)
 
-	dht := node.NewDHT("node1")
+	owners := cluster[addrs[0]].OwnersOf(key, n)
+	for _, addr := range addrs {
+		isOwner := false
+		for _, o := range owners {
+			isOwner = isOwner || o == addr
+		}
+		if !isOwner {
+			return cluster[addr]
+		}
+	}
+	t.Fatalf("Every node owns %s", key)
+	return nil
+}
 
-	dht.AddNode("node2")
-	dht.AddNode("node3")
+func TestDHT(t *testing.T) {
+	_, dhts := newCluster(t, "node1", "node2", "node3")
+	dht := dhts[0]
 
 	nodes := dht.ListNodes()
 	if len(nodes) != 2 {
 		t.Fatalf("Expected 2 nodes, got %d", len(nodes))
 	}
 
-	dht.Put("file1", "chunk1_location", 3)
-	value, err := dht.Get("file1")
+	if err := dht.Put(context.Background(), "file1", "chunk1_location", node.WriteOpts{}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	value, err := dht.Get(context.Background(), "file1", node.ReadOpts{})
 	if err != nil || value != "chunk1_location" {
 		t.Fatalf("Expected chunk1_location, got %s", value)
 	}
@@ -60,26 +111,1036 @@ func TestDHT(t *testing.T) {
 }
 
 func TestDHTReplication(t *testing.T) {
-	_, err := loadTLSConfig()
+	_, dhts := newCluster(t, "node1", "node2", "node3")
+	dht := dhts[0]
+
+	dht.PutLocal("file1", "chunk1_location")
+
+	err := dht.Replicate("file1", "chunk1_location")
 	if err != nil {
-		t.Fatalf("Failed to load TLS config: %v", err)
+		t.Fatalf("Failed to replicate key: %s", err)
+	}
+
+	for _, replica := range dhts {
+		value, err := replica.GetLocal("file1")
+		if err != nil || value != "chunk1_location" {
+			t.Fatalf("Expected chunk1_location, got %s (%v)", value, err)
+		}
 	}
+}
+
+func TestDHTReplicationFailures(t *testing.T) {
+	network, dhts := newCluster(t, "node1", "node2", "node3")
+	dht := dhts[0]
+
+	network.Down("node3")
+	if err := dht.Replicate("file1", "chunk1_location"); err == nil {
+		t.Fatal("Expected replication to a down node to fail")
+	}
+	network.Up("node3")
+
+	network.Partition("node1", "node2")
+	if err := dht.PutConsistent("file2", "chunk2_location", 3); err == nil {
+		t.Fatal("Expected replication across a partition to fail")
+	}
+	if _, err := dhts[1].GetLocal("file2"); err == nil {
+		t.Fatal("Expected partitioned node not to receive the key")
+	}
+
+	network.HealAll()
+	if err := dht.PutConsistent("file2", "chunk2_location", 3); err != nil {
+		t.Fatalf("Failed to replicate after healing: %v", err)
+	}
+	for _, replica := range dhts {
+		if value, err := replica.GetLocal("file2"); err != nil || value != "chunk2_location" {
+			t.Fatalf("Expected chunk2_location, got %s (%v)", value, err)
+		}
+	}
+}
+
+func TestDHTFlappingNode(t *testing.T) {
+	chaos := p2p.NewChaos(1)
+	dhts := newChaosCluster(t, chaos, "node1", "node2", "node3")
+	dht := dhts[0]
 
-	dht := node.NewDHT("node1")
+	chaos.SchedulePartition("node1", "node2", 0, 200*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
 
-	dht.AddNode("node2")
-	dht.AddNode("node3")
+	if err := dht.PutConsistent("file1", "chunk1_location", 3); err == nil {
+		t.Fatal("Expected write to fail while node2 is partitioned away")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if err := dht.PutConsistent("file1", "chunk1_location", 3); err != nil {
+		t.Fatalf("Expected write to succeed once node2 is back: %v", err)
+	}
+	for _, replica := range dhts {
+		if value, err := replica.GetLocal("file1"); err != nil || value != "chunk1_location" {
+			t.Fatalf("Expected chunk1_location, got %s (%v)", value, err)
+		}
+	}
+}
 
-	dht.Put("file1", "chunk1_location", 3)
+func TestDHTLossyNetwork(t *testing.T) {
+	chaos := p2p.NewChaos(42)
+	chaos.SetFaults(p2p.Faults{
+		Jitter:        2 * time.Millisecond,
+		DropRate:      0.2,
+		DuplicateRate: 0.3,
+		ReorderRate:   0.2,
+		ReorderDelay:  5 * time.Millisecond,
+	})
+	dhts := newChaosCluster(t, chaos, "node1", "node2", "node3")
 
-	// Simulate replication
-	err = dht.Replicate("file1", "chunk1_location")
+	// a write that reports success must be on every replica, whatever was
+	// dropped, duplicated or reordered along the way
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := dhts[0].Replicate(key, "value"); err != nil {
+			continue
+		}
+		succeeded++
+		for _, replica := range dhts[1:] {
+			if value, err := replica.GetLocal(key); err != nil || value != "value" {
+				t.Fatalf("Replicate of %s reported success but replica has %q (%v)", key, value, err)
+			}
+		}
+	}
+	if succeeded == 0 {
+		t.Fatal("Expected some writes to get through with retries")
+	}
+}
+
+func TestFileUploadWithFlappingNode(t *testing.T) {
+	chaos := p2p.NewChaos(7)
+	dhts := newChaosCluster(t, chaos, "node1", "node2", "node3")
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "upload.bin")
+	if err := os.WriteFile(src, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("Failed to write upload: %v", err)
+	}
+	key := make([]byte, 32)
+	fm := file.NewFileManager(1024, dhts[0], dir)
+
+	chaos.Partition("node1", "node3")
+	if err := fm.UploadEncryptedFile(src, key); err == nil {
+		t.Fatal("Expected upload to fail while a replica is unreachable")
+	}
+
+	chaos.Heal("node1", "node3")
+	if err := fm.UploadEncryptedFile(src, key); err != nil {
+		t.Fatalf("Expected upload to succeed after healing: %v", err)
+	}
+
+	chunks, err := file.SplitFile(src, 1024)
 	if err != nil {
-		t.Fatalf("Failed to replicate key: %s", err)
+		t.Fatalf("Failed to split file: %v", err)
+	}
+	for _, chunk := range chunks {
+		for _, replica := range dhts {
+			if _, err := replica.GetLocal(chunk.ID); err != nil {
+				t.Fatalf("Chunk %s missing on a replica: %v", chunk.ID, err)
+			}
+		}
 	}
+}
 
-	value, err := dht.Get("file1")
-	if err != nil || value != "chunk1_location" {
-		t.Fatalf("Expected chunk1_location, got %s", value)
+func TestRingPlacement(t *testing.T) {
+	addrs := []string{"node1", "node2", "node3", "node4", "node5"}
+	_, dhts := newCluster(t, addrs...)
+
+	counts := make(map[string]int)
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("file-%d-chunk-0", i)
+		owners := dhts[0].OwnersOf(key, 3)
+		if len(owners) != 3 {
+			t.Fatalf("Expected 3 owners for %s, got %v", key, owners)
+		}
+		if owners[0] == owners[1] || owners[1] == owners[2] || owners[0] == owners[2] {
+			t.Fatalf("Owners of %s are not distinct: %v", key, owners)
+		}
+
+		// every node must agree on placement
+		for _, d := range dhts[1:] {
+			if other := d.OwnersOf(key, 3); fmt.Sprint(other) != fmt.Sprint(owners) {
+				t.Fatalf("Nodes disagree on owners of %s: %v vs %v", key, owners, other)
+			}
+		}
+		counts[owners[0]]++
+	}
+
+	// with virtual nodes every primary share stays near keys/len(addrs)
+	for _, addr := range addrs {
+		share := float64(counts[addr]) / keys
+		if share < 0.1 || share > 0.3 {
+			t.Fatalf("Uneven placement, %s is primary for %.0f%% of keys", addr, share*100)
+		}
+	}
+}
+
+func TestPutConsistentWritesOwners(t *testing.T) {
+	addrs := []string{"node1", "node2", "node3", "node4", "node5"}
+	_, dhts := newCluster(t, addrs...)
+	byAddr := byAddress(addrs, dhts)
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := dhts[0].PutConsistent(key, "value", 2); err != nil {
+			t.Fatalf("PutConsistent failed: %v", err)
+		}
+
+		owners := dhts[0].OwnersOf(key, 2)
+		isOwner := map[string]bool{owners[0]: true, owners[1]: true}
+		for addr, d := range byAddr {
+			_, err := d.GetLocal(key)
+			if isOwner[addr] && err != nil {
+				t.Fatalf("Owner %s is missing %s", addr, key)
+			}
+			if !isOwner[addr] && err == nil {
+				t.Fatalf("Non-owner %s stored %s", addr, key)
+			}
+		}
+	}
+}
+
+// starts n nodes that each only know the node before them
+func newChain(t *testing.T, n int) []*node.DHT {
+	t.Helper()
+	network := p2p.NewMemNetwork()
+	dhts := make([]*node.DHT, n)
+	for i := range dhts {
+		addr := fmt.Sprintf("node%d", i)
+		dhts[i] = node.NewDHT(addr, node.WithTransport(network.NewTransport(addr)))
+		t.Cleanup(func() { dhts[i].Close() })
+		if i > 0 {
+			dhts[i].AddNode(fmt.Sprintf("node%d", i-1))
+		}
+	}
+	return dhts
+}
+
+func TestKademliaBootstrapFindsNodes(t *testing.T) {
+	dhts := newChain(t, 40)
+	bootstrapChain(t, dhts)
+	ctx := context.Background()
+
+	// node0 started out knowing nobody and learned of others only as they joined
+	for _, target := range []string{"node7", "node23", "node39"} {
+		closest, err := dhts[0].FindNode(ctx, node.NewNodeID(target))
+		if err != nil {
+			t.Fatalf("FindNode(%s) failed: %v", target, err)
+		}
+		if len(closest) == 0 || closest[0] != target {
+			t.Fatalf("Expected %s to be closest to its own ID, got %v", target, closest)
+		}
+	}
+}
+
+// bootstraps every node of a chain through the node before it
+func bootstrapChain(t *testing.T, dhts []*node.DHT) {
+	t.Helper()
+	for i, d := range dhts[1:] {
+		if err := d.Bootstrap(context.Background()); err != nil {
+			t.Fatalf("node%d failed to bootstrap: %v", i+1, err)
+		}
+	}
+}
+
+func TestKademliaFindValue(t *testing.T) {
+	dhts := newChain(t, 30)
+	bootstrapChain(t, dhts)
+	ctx := context.Background()
+
+	key := "file1-chunk-0"
+	if err := dhts[7].Put(ctx, key, "chunk1_location", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	for _, d := range []*node.DHT{dhts[0], dhts[15], dhts[29]} {
+		value, err := d.FindValue(ctx, key)
+		if err != nil || value != "chunk1_location" {
+			t.Fatalf("Expected chunk1_location, got %q (%v)", value, err)
+		}
+	}
+	if _, err := dhts[3].FindValue(ctx, "missing"); err == nil {
+		t.Fatal("Expected lookup of a missing key to fail")
+	}
+}
+
+func TestBootstrappedClusterAgreesOnOwners(t *testing.T) {
+	dhts := newChain(t, 100)
+	bootstrapChain(t, dhts)
+	ctx := context.Background()
+
+	// k-buckets keep every node from knowing the whole cluster
+	for i, d := range dhts {
+		if known := len(d.ListNodes()); known >= len(dhts)-1 {
+			t.Fatalf("node%d knows all %d other nodes", i, known)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("file-%d", i)
+		owners, err := dhts[0].FindOwners(ctx, key, 3)
+		if err != nil {
+			t.Fatalf("FindOwners failed: %v", err)
+		}
+		for _, j := range []int{i + 1, i + 37, i + 71} {
+			other, err := dhts[j%len(dhts)].FindOwners(ctx, key, 3)
+			if err != nil || fmt.Sprint(other) != fmt.Sprint(owners) {
+				t.Fatalf("node%d disagrees on owners of %s: %v vs %v (%v)", j%len(dhts), key, other, owners, err)
+			}
+		}
+
+		// written through one node, read back through others
+		writer, reader := dhts[i%len(dhts)], dhts[(i+17)%len(dhts)]
+		if err := writer.Put(ctx, key, "v", node.WriteOpts{N: 3, W: 3}); err != nil {
+			t.Fatalf("Put of %s failed: %v", key, err)
+		}
+		if value, err := reader.Get(ctx, key, node.ReadOpts{N: 3, R: 3}); err != nil || value != "v" {
+			t.Fatalf("Expected v for %s, got %q (%v)", key, value, err)
+		}
+		if value, err := dhts[(i+53)%len(dhts)].FindValue(ctx, key); err != nil || value != "v" {
+			t.Fatalf("Expected FindValue to find v for %s, got %q (%v)", key, value, err)
+		}
+	}
+}
+
+func TestRoutingTableBuckets(t *testing.T) {
+	rt := node.NewRoutingTable("self")
+	for i := 0; i < 500; i++ {
+		rt.Update(fmt.Sprintf("node%d", i))
+	}
+	if rt.Len() >= 500 {
+		t.Fatalf("Expected full buckets to refuse contacts, have %d", rt.Len())
+	}
+
+	target := node.NewNodeID("node42")
+	closest := rt.Closest(target, node.BucketSize)
+	for i := 1; i < len(closest); i++ {
+		if closest[i].ID.Closer(closest[i-1].ID, target) {
+			t.Fatalf("Closest is not ordered by distance at %d", i)
+		}
+	}
+}
+
+func TestRemoteGet(t *testing.T) {
+	addrs := []string{"node1", "node2", "node3", "node4", "node5"}
+	network, dhts := newCluster(t, addrs...)
+	byAddr := byAddress(addrs, dhts)
+
+	ctx := context.Background()
+	key := "file1"
+	owners := dhts[0].OwnersOf(key, node.DefaultReplicationFactor)
+	outsider := nonOwner(t, byAddr, key, node.DefaultReplicationFactor)
+
+	// replicas disagree, the write that supersedes the other must win
+	if err := outsider.Put(ctx, key, "old", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	network.Down(owners[0])
+	if err := outsider.Put(ctx, key, "new", node.WriteOpts{N: 3, W: 2}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	network.Up(owners[0])
+
+	if _, err := outsider.GetLocal(key); err == nil {
+		t.Fatal("Expected the outsider to hold no local copy")
+	}
+	if value, err := outsider.Get(ctx, key, node.ReadOpts{R: 3}); err != nil || value != "new" {
+		t.Fatalf("Expected new, got %q (%v)", value, err)
+	}
+
+	if _, err := outsider.Get(ctx, "missing", node.ReadOpts{}); err == nil {
+		t.Fatal("Expected a missing key to fail")
+	}
+
+	for _, o := range owners {
+		network.Down(o)
+	}
+	if _, err := outsider.Get(ctx, key, node.ReadOpts{R: 1}); !errors.Is(err, node.ErrQuorum) {
+		t.Fatal("Expected Get to fail with every owner down")
+	}
+}
+
+func TestQuorumWrites(t *testing.T) {
+	addrs := []string{"node1", "node2", "node3", "node4", "node5"}
+	network, dhts := newCluster(t, addrs...)
+	ctx := context.Background()
+
+	key := "file1"
+	owners := dhts[0].OwnersOf(key, 3)
+	coordinator := nonOwner(t, byAddress(addrs, dhts), key, 3)
+
+	// one replica down still leaves a majority
+	network.Down(owners[2])
+	if err := coordinator.Put(ctx, key, "v1", node.WriteOpts{N: 3, W: 2}); err != nil {
+		t.Fatalf("Expected W=2 write to succeed with one replica down: %v", err)
+	}
+	if err := coordinator.Put(ctx, key, "v2", node.WriteOpts{N: 3, W: 3}); !errors.Is(err, node.ErrQuorum) {
+		t.Fatalf("Expected W=3 write to miss quorum, got %v", err)
+	}
+	if value, err := coordinator.Get(ctx, key, node.ReadOpts{N: 3, R: 2}); err != nil || value != "v2" {
+		t.Fatalf("Expected v2 from the replicas that took it, got %q (%v)", value, err)
+	}
+
+	network.Down(owners[1])
+	if _, err := coordinator.Get(ctx, key, node.ReadOpts{N: 3, R: 2}); !errors.Is(err, node.ErrQuorum) {
+		t.Fatalf("Expected R=2 read to miss quorum with two replicas down, got %v", err)
+	}
+	if value, err := coordinator.Get(ctx, key, node.ReadOpts{N: 3, R: 1}); err != nil || value != "v2" {
+		t.Fatalf("Expected R=1 read to succeed, got %q (%v)", value, err)
+	}
+}
+
+func TestVectorClockCompare(t *testing.T) {
+	a := node.VectorClock{"node1": 1}
+	b := node.VectorClock{"node1": 2}
+	c := node.VectorClock{"node1": 1, "node2": 1}
+
+	cases := []struct {
+		x, y node.VectorClock
+		want node.Ordering
+	}{
+		{a, a, node.Equal},
+		{a, b, node.Before},
+		{b, a, node.After},
+		{a, c, node.Before},
+		{b, c, node.Concurrent},
+		{nil, a, node.Before},
+		{a.Merge(c), c, node.Equal},
+	}
+	for _, tc := range cases {
+		if got := tc.x.Compare(tc.y); got != tc.want {
+			t.Fatalf("Compare(%v, %v) = %v, want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestConcurrentWritesKeepSiblings(t *testing.T) {
+	network, dhts := newCluster(t, "node1", "node2", "node3")
+	ctx := context.Background()
+	all := node.WriteOpts{N: 3, W: 3}
+
+	// node1 and node3 write without seeing each other's value
+	network.Partition("node1", "node3")
+	if err := dhts[0].Put(ctx, "file1", "a", node.WriteOpts{N: 3, W: 2}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := dhts[2].Put(ctx, "file1", "b", node.WriteOpts{N: 3, W: 2}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	network.HealAll()
+
+	entry, err := dhts[1].GetVersions(ctx, "file1", node.ReadOpts{R: 3})
+	if err != nil {
+		t.Fatalf("GetVersions failed: %v", err)
+	}
+	if len(entry.Siblings) != 1 {
+		t.Fatalf("Expected the concurrent writes to be kept as siblings, got %+v", entry)
+	}
+	values := map[string]bool{}
+	for _, v := range entry.Versions() {
+		values[v.Value] = true
+	}
+	if !values["a"] || !values["b"] {
+		t.Fatalf("Expected siblings a and b, got %v", values)
+	}
+
+	// a write that has seen both settles the conflict
+	if err := dhts[1].Put(ctx, "file1", "a+b", node.WriteOpts{N: 3, W: 3, Context: entry.Context()}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	entry, err = dhts[0].GetVersions(ctx, "file1", node.ReadOpts{R: 3})
+	if err != nil || entry.Value != "a+b" || len(entry.Siblings) != 0 {
+		t.Fatalf("Expected a+b without siblings, got %+v (%v)", entry, err)
+	}
+
+	// a later write from the same coordinator supersedes its earlier one
+	if err := dhts[2].Put(ctx, "file1", "c", all); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := dhts[2].Put(ctx, "file1", "d", all); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if entry, _ := dhts[0].GetVersions(ctx, "file1", node.ReadOpts{R: 3}); entry.Value != "d" || len(entry.Siblings) != 0 {
+		t.Fatalf("Expected d without siblings, got %+v", entry)
+	}
+}
+
+func TestResolverMergesSiblings(t *testing.T) {
+	resolver := func(key string, versions []node.DataEntry) string {
+		var values []string
+		for _, v := range versions {
+			values = append(values, v.Value)
+		}
+		sort.Strings(values)
+		return strings.Join(values, ",")
+	}
+
+	network, dhts := startCluster(t, nil, []node.Option{node.WithResolver(resolver)}, "node1", "node2")
+	ctx := context.Background()
+	network.Partition("node1", "node2")
+	dhts[0].Put(ctx, "file1", "x", node.WriteOpts{N: 2, W: 1})
+	dhts[1].Put(ctx, "file1", "y", node.WriteOpts{N: 2, W: 1})
+	network.HealAll()
+
+	if value, err := dhts[0].Get(ctx, "file1", node.ReadOpts{R: 2}); err != nil || value != "x,y" {
+		t.Fatalf("Expected resolver to merge to x,y, got %q (%v)", value, err)
+	}
+}
+
+// a node whose clock went back since its last write must still supersede it
+func TestWriteAfterClockWentBack(t *testing.T) {
+	store := node.NewMemStore()
+	ahead := uint64(time.Now().Add(time.Hour).UnixNano())
+	store.Put("file1", node.DataEntry{Value: "old", Version: int64(ahead), Timestamp: time.Now(), Clock: node.VectorClock{"node1": ahead}})
+
+	d, err := node.OpenDHT("node1", node.WithStore(store), node.WithTransport(p2p.NewMemNetwork().NewTransport("node1")))
+	if err != nil {
+		t.Fatalf("OpenDHT failed: %v", err)
+	}
+	defer d.Close()
+	if err := d.Put(context.Background(), "file1", "new", node.WriteOpts{N: 1, W: 1}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if value, err := d.GetLocal("file1"); err != nil || value != "new" {
+		t.Fatalf("Expected new, got %q (%v)", value, err)
+	}
+}
+
+func newHintedCluster(t *testing.T, interval time.Duration, addrs ...string) (*p2p.MemNetwork, []*node.DHT) {
+	t.Helper()
+	return startCluster(t, nil, []node.Option{node.WithHintedHandoff(interval)}, addrs...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHintedHandoffReplaysOnInterval(t *testing.T) {
+	network, dhts := newHintedCluster(t, 20*time.Millisecond, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	network.Down("node3")
+	// the hint is kept but doesn't stand in for node3's acknowledgement
+	if err := dhts[0].Put(ctx, "file1", "chunk1_location", node.WriteOpts{N: 3, W: 3}); !errors.Is(err, node.ErrQuorum) {
+		t.Fatalf("Expected the write to miss quorum with node3 down, got %v", err)
+	}
+	if hints := dhts[0].PendingHints(); hints["node3"] != 1 {
+		t.Fatalf("Expected one hint for node3, got %v", hints)
+	}
+	if _, err := dhts[2].GetLocal("file1"); err == nil {
+		t.Fatal("Expected node3 not to have the key while down")
+	}
+
+	network.Up("node3")
+	waitFor(t, "hint replay", func() bool {
+		value, err := dhts[2].GetLocal("file1")
+		return err == nil && value == "chunk1_location"
+	})
+	waitFor(t, "hints to clear", func() bool { return len(dhts[0].PendingHints()) == 0 })
+}
+
+func TestHintedHandoffReplaysOnReconnect(t *testing.T) {
+	network, dhts := newHintedCluster(t, time.Hour, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	network.Down("node3")
+	if err := dhts[0].PutConsistent("file1", "chunk1_location", 3); !errors.Is(err, node.ErrQuorum) {
+		t.Fatalf("Expected PutConsistent to fail with node3 down, got %v", err)
+	}
+
+	// node3 coming back and talking to node1 is enough to trigger replay
+	network.Up("node3")
+	dhts[2].Get(ctx, "other", node.ReadOpts{R: 3})
+	waitFor(t, "hint replay", func() bool {
+		value, err := dhts[2].GetLocal("file1")
+		return err == nil && value == "chunk1_location"
+	})
+}
+
+func TestAntiEntropyRepairsMissedWrites(t *testing.T) {
+	network, dhts := newCluster(t, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	network.Down("node3")
+	for i := 0; i < 50; i++ {
+		if err := dhts[0].Put(ctx, fmt.Sprintf("key-%d", i), "value", node.WriteOpts{N: 3, W: 2}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	network.Up("node3")
+	// node3 has a write of its own the others missed
+	dhts[2].PutLocal("only-on-node3", "value")
+
+	n, err := dhts[2].SyncWith(ctx, "node1")
+	if err != nil {
+		t.Fatalf("SyncWith failed: %v", err)
+	}
+	if n == 0 {
+		t.Fatal("Expected diverged replicas to exchange entries")
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := dhts[2].GetLocal(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatalf("key-%d not repaired on node3", i)
+		}
+	}
+	if _, err := dhts[0].GetLocal("only-on-node3"); err != nil {
+		t.Fatal("Expected node1 to receive node3's write")
+	}
+
+	if n, err := dhts[2].SyncWith(ctx, "node1"); err != nil || n != 0 {
+		t.Fatalf("Expected replicas to be in sync, exchanged %d (%v)", n, err)
+	}
+
+	// trees kept from the last comparison pick up later changes
+	dhts[0].PutLocal("key-7", "changed")
+	if n, err := dhts[2].SyncWith(ctx, "node1"); err != nil || n == 0 {
+		t.Fatalf("Expected the changed key to be exchanged, exchanged %d (%v)", n, err)
+	}
+	if value, _ := dhts[2].GetLocal("key-7"); value != "changed" {
+		t.Fatalf("Expected node3 to receive the change, got %q", value)
+	}
+}
+
+func TestAntiEntropyRunsInBackground(t *testing.T) {
+	_, dhts := startCluster(t, nil, []node.Option{node.WithAntiEntropy(20 * time.Millisecond)}, "node1", "node2")
+
+	dhts[0].PutLocal("file1", "chunk1_location")
+	waitFor(t, "anti-entropy", func() bool {
+		value, err := dhts[1].GetLocal("file1")
+		return err == nil && value == "chunk1_location"
+	})
+}
+
+func TestReadRepair(t *testing.T) {
+	network, dhts := newCluster(t, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	network.Down("node3")
+	if err := dhts[0].Put(ctx, "file1", "chunk1_location", node.WriteOpts{N: 3, W: 2}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// let the write's retries to node3 give up before it comes back
+	time.Sleep(20 * time.Millisecond)
+	network.Up("node3")
+
+	if value, err := dhts[1].Get(ctx, "file1", node.ReadOpts{R: 1}); err != nil || value != "chunk1_location" {
+		t.Fatalf("Expected chunk1_location, got %q (%v)", value, err)
+	}
+	waitFor(t, "read repair", func() bool {
+		value, err := dhts[2].GetLocal("file1")
+		return err == nil && value == "chunk1_location"
+	})
+
+	waitFor(t, "read repair metrics", func() bool {
+		m := dhts[1].Metrics()
+		return m.Reads == 1 && m.ReadRepairs == 1 && m.ReadRepairWrites == 1
+	})
+
+	// replicas agree now, nothing to repair
+	dhts[1].Get(ctx, "file1", node.ReadOpts{R: 3})
+	time.Sleep(20 * time.Millisecond)
+	if m := dhts[1].Metrics(); m.ReadRepairs != 1 {
+		t.Fatalf("Expected no further repairs, got %+v", m)
+	}
+}
+
+func TestDurableStorageSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *node.DHT {
+		d, err := node.OpenDHT("node1", node.WithDataDir(dir, time.Hour), node.WithTransport(p2p.NewMemNetwork().NewTransport("node1")))
+		if err != nil {
+			t.Fatalf("OpenDHT failed: %v", err)
+		}
+		return d
+	}
+
+	d := open()
+	d.PutLocal("file1", "chunk1_location")
+	d.PutLocal("file2", "chunk2_location")
+	d.Remove("file2")
+	// Close snapshots, so the next change only lives in the WAL
+	d.Close()
+
+	// this one is never closed, as if the process crashed
+	d = open()
+	d.PutLocal("file3", "chunk3_location")
+	// a record torn halfway through by the crash
+	f, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	f.WriteString(`1234abcd {"op":"put","key":"torn"`)
+	f.Close()
+
+	d2, err := node.OpenDHT("node1", node.WithDataDir(dir, time.Hour), node.WithTransport(p2p.NewMemNetwork().NewTransport("node1")))
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	t.Cleanup(func() { d2.Close() })
+
+	for key, want := range map[string]string{"file1": "chunk1_location", "file3": "chunk3_location"} {
+		if value, err := d2.GetLocal(key); err != nil || value != want {
+			t.Fatalf("Expected %s after restart, got %q (%v)", want, value, err)
+		}
+	}
+	for _, key := range []string{"file2", "torn"} {
+		if _, err := d2.GetLocal(key); err == nil {
+			t.Fatalf("Expected %s to be gone after restart", key)
+		}
+	}
+}
+
+func TestOpenDHTReportsUnreadableDataDir(t *testing.T) {
+	// a file where the data dir should be
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if _, err := node.OpenDHT("node1", node.WithDataDir(dir, time.Hour), node.WithTransport(p2p.NewMemNetwork().NewTransport("node1"))); err == nil {
+		t.Fatal("Expected OpenDHT to fail")
+	}
+}
+
+func TestSnapshotCompactsWAL(t *testing.T) {
+	dir := t.TempDir()
+	d, err := node.OpenDHT("node1", node.WithDataDir(dir, 20*time.Millisecond), node.WithTransport(p2p.NewMemNetwork().NewTransport("node1")))
+	if err != nil {
+		t.Fatalf("OpenDHT failed: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	for i := 0; i < 100; i++ {
+		d.PutLocal("file1", fmt.Sprintf("v%d", i))
+	}
+	waitFor(t, "snapshot", func() bool {
+		info, err := os.Stat(filepath.Join(dir, "wal.log"))
+		return err == nil && info.Size() == 0
+	})
+	if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); err != nil {
+		t.Fatalf("Expected a snapshot: %v", err)
+	}
+}
+
+func TestTTLExpiresOnEveryReplica(t *testing.T) {
+	_, dhts := startCluster(t, nil, []node.Option{node.WithReapInterval(10 * time.Millisecond)}, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	if err := dhts[0].Put(ctx, "session1", "upload", node.WriteOpts{N: 3, W: 3, TTL: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := dhts[0].Put(ctx, "file1", "chunk1_location", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	for i, d := range dhts {
+		if value, err := d.GetLocal("session1"); err != nil || value != "upload" {
+			t.Fatalf("Expected node%d to hold the session before it expires, got %q (%v)", i+1, value, err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := dhts[1].Get(ctx, "session1", node.ReadOpts{}); err == nil {
+		t.Fatal("Expected an expired key to be missing")
+	}
+	for i, d := range dhts {
+		waitFor(t, fmt.Sprintf("node%d to reap session1", i+1), func() bool {
+			return d.Metrics().Expired == 1
+		})
+		if _, ok := d.GetAllData()["session1"]; ok {
+			t.Fatalf("Expected node%d to have removed session1", i+1)
+		}
+		if value, err := d.GetLocal("file1"); err != nil || value != "chunk1_location" {
+			t.Fatalf("Expected node%d to keep file1, got %q (%v)", i+1, value, err)
+		}
+	}
+}
+
+func TestDeleteWritesReplicatedTombstone(t *testing.T) {
+	opts := []node.Option{node.WithTombstoneGrace(200 * time.Millisecond), node.WithReapInterval(10 * time.Millisecond)}
+	network, dhts := startCluster(t, nil, opts, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	if err := dhts[0].Put(ctx, "file1", "chunk1_location", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	network.Down("node3")
+	if err := dhts[0].Delete(ctx, "file1", node.WriteOpts{N: 3, W: 2}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := dhts[1].Get(ctx, "file1", node.ReadOpts{N: 3, R: 2}); err == nil {
+		t.Fatal("Expected a deleted key to be missing")
+	}
+	// let the delete's retries to node3 give up before it comes back
+	time.Sleep(20 * time.Millisecond)
+	network.Up("node3")
+
+	// node3 still has the value, syncing must not bring it back
+	if value, err := dhts[2].GetLocal("file1"); err != nil || value != "chunk1_location" {
+		t.Fatalf("Expected node3 to have missed the delete, got %q (%v)", value, err)
+	}
+	if _, err := dhts[0].SyncWith(ctx, "node3"); err != nil {
+		t.Fatalf("SyncWith failed: %v", err)
+	}
+	for i, d := range dhts {
+		if _, err := d.GetLocal("file1"); err == nil {
+			t.Fatalf("Expected node%d to hold the tombstone", i+1)
+		}
+	}
+	if _, err := dhts[2].Get(ctx, "file1", node.ReadOpts{N: 3, R: 3}); err == nil {
+		t.Fatal("Expected a deleted key to be missing")
+	}
+
+	for i, d := range dhts {
+		waitFor(t, fmt.Sprintf("node%d to collect the tombstone", i+1), func() bool {
+			return d.Metrics().TombstonesCollected == 1
+		})
+	}
+}
+
+func TestDeleteFromNonOwner(t *testing.T) {
+	addrs := []string{"node1", "node2", "node3", "node4", "node5"}
+	_, dhts := newCluster(t, addrs...)
+	byAddr := byAddress(addrs, dhts)
+	ctx := context.Background()
+
+	key := "file1"
+	owners := dhts[0].OwnersOf(key, 3)
+	outsider := nonOwner(t, byAddr, key, 3)
+
+	if err := byAddr[owners[0]].Put(ctx, key, "v", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// the outsider holds no copy, its tombstone must still supersede the owners'
+	if err := outsider.Remove(key); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	waitFor(t, "the delete to reach every owner", func() bool {
+		_, err := byAddr[owners[1]].Get(ctx, key, node.ReadOpts{N: 3, R: 3})
+		return errors.Is(err, node.ErrNotFound)
+	})
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	_, dhts := newCluster(t, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	if err := dhts[0].PutIfAbsent(ctx, "file1", "v1", node.WriteOpts{}); err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	if err := dhts[1].PutIfAbsent(ctx, "file1", "other", node.WriteOpts{}); !errors.Is(err, node.ErrVersionMismatch) {
+		t.Fatalf("Expected PutIfAbsent of an existing key to fail, got %v", err)
+	}
+
+	entry, err := dhts[1].GetVersions(ctx, "file1", node.ReadOpts{})
+	if err != nil {
+		t.Fatalf("GetVersions failed: %v", err)
+	}
+	if err := dhts[1].CompareAndSwap(ctx, "file1", entry.Version, "v2", node.WriteOpts{}); err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if err := dhts[2].CompareAndSwap(ctx, "file1", entry.Version, "v3", node.WriteOpts{}); !errors.Is(err, node.ErrVersionMismatch) {
+		t.Fatalf("Expected a swap from a stale version to fail, got %v", err)
+	}
+	if value, err := dhts[2].Get(ctx, "file1", node.ReadOpts{R: 3}); err != nil || value != "v2" {
+		t.Fatalf("Expected v2, got %q (%v)", value, err)
+	}
+}
+
+func TestConcurrentSwapsFromOneVersion(t *testing.T) {
+	_, dhts := newCluster(t, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	if err := dhts[0].Put(ctx, "file1", "v1", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	entry, err := dhts[0].GetVersions(ctx, "file1", node.ReadOpts{})
+	if err != nil {
+		t.Fatalf("GetVersions failed: %v", err)
+	}
+
+	// two uploaders, node3 takes exactly one of their swaps
+	uploaders := dhts[:2]
+	errs := make(chan error, len(uploaders))
+	for i, d := range uploaders {
+		go func() {
+			errs <- d.CompareAndSwap(ctx, "file1", entry.Version, fmt.Sprintf("uploader%d", i+1), node.WriteOpts{})
+		}()
+	}
+	won := 0
+	for range uploaders {
+		err := <-errs
+		if err == nil {
+			won++
+		} else if !errors.Is(err, node.ErrVersionMismatch) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("Expected exactly one swap to win, %d did", won)
+	}
+}
+
+func TestSwapAfterLostRace(t *testing.T) {
+	network, dhts := newCluster(t, "node1", "node2", "node3")
+	ctx := context.Background()
+
+	if err := dhts[0].Put(ctx, "file1", "v1", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// what a swap that lost the race leaves behind: node1 applied it, the
+	// other owners took the winner
+	network.Partition("node1", "node2")
+	network.Partition("node1", "node3")
+	dhts[0].PutLocal("file1", "loser")
+	if err := dhts[1].Put(ctx, "file1", "winner", node.WriteOpts{N: 3, W: 2}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	network.HealAll()
+
+	entry, err := dhts[0].GetVersions(ctx, "file1", node.ReadOpts{})
+	if err != nil {
+		t.Fatalf("GetVersions failed: %v", err)
+	}
+	if len(entry.Siblings) != 1 {
+		t.Fatalf("Expected the lost swap as a sibling, got %+v", entry)
+	}
+	if err := dhts[0].CompareAndSwap(ctx, "file1", entry.Version, "v2", node.WriteOpts{}); err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	entry, err = dhts[2].GetVersions(ctx, "file1", node.ReadOpts{R: 3})
+	if err != nil || entry.Value != "v2" || len(entry.Siblings) != 0 {
+		t.Fatalf("Expected v2 alone, got %+v (%v)", entry, err)
+	}
+}
+
+// the next event on events, failing after a second
+func nextEvent(t *testing.T, events <-chan node.Event) node.Event {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return node.Event{}
+	}
+}
+
+func TestWatchStreamsChanges(t *testing.T) {
+	_, dhts := newCluster(t, "node1", "node2", "node3")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := dhts[0].Watch(ctx, "file")
+
+	// reported by all three replicas, delivered once
+	if err := dhts[1].Put(ctx, "file1", "chunk1_location", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if ev := nextEvent(t, events); ev.Type != node.EventPut || ev.Key != "file1" || ev.Value != "chunk1_location" {
+		t.Fatalf("Unexpected event %+v", ev)
+	}
+
+	// a key only another node holds
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("file-%d", i); dhts[0].OwnersOf(k, 1)[0] != "node1" {
+			key = k
+		}
+	}
+	if err := dhts[1].Put(ctx, key, "remote", node.WriteOpts{N: 1, W: 1}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if ev := nextEvent(t, events); ev.Type != node.EventPut || ev.Key != key || ev.Node == "node1" {
+		t.Fatalf("Unexpected event %+v", ev)
+	}
+
+	// outside the prefix
+	dhts[1].Put(ctx, "other", "ignored", node.WriteOpts{N: 3, W: 3})
+	if err := dhts[2].Delete(ctx, "file1", node.WriteOpts{N: 3, W: 3}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if ev := nextEvent(t, events); ev.Type != node.EventDelete || ev.Key != "file1" {
+		t.Fatalf("Unexpected event %+v", ev)
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("Expected no further events, got %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	waitFor(t, "the watch to close", func() bool {
+		_, open := <-events
+		return !open
+	})
+}
+
+func TestWatchKeepsRemoteChangesInOrder(t *testing.T) {
+	_, dhts := newCluster(t, "node1", "node2")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := dhts[0].Watch(ctx, "file")
+	for i := 0; i < 20; i++ {
+		dhts[1].PutLocal("file1", fmt.Sprint(i))
+	}
+	for i := 0; i < 20; i++ {
+		if ev := nextEvent(t, events); ev.Value != fmt.Sprint(i) {
+			t.Fatalf("Expected change %d, got %+v", i, ev)
+		}
+	}
+}
+
+func TestScanPaginatesInKeyOrder(t *testing.T) {
+	d := node.NewDHT("node1", node.WithTransport(p2p.NewMemNetwork().NewTransport("node1")))
+	defer d.Close()
+
+	for i := 0; i < 25; i++ {
+		d.PutLocal(fmt.Sprintf("file%02d", i), fmt.Sprintf("chunk%d_location", i))
+	}
+	d.PutLocal("archive", "skipped")
+	d.PutLocal("other", "skipped")
+	d.Remove("file07")
+
+	var keys []string
+	after := ""
+	for {
+		page, err := d.Scan("file", after, 10)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		for _, e := range page {
+			keys = append(keys, e.Key)
+		}
+		if len(page) < 10 {
+			break
+		}
+		after = page[len(page)-1].Key
+	}
+
+	if len(keys) != 24 || !sort.StringsAreSorted(keys) {
+		t.Fatalf("Expected the 24 live file keys in order, got %v", keys)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "file") || key == "file07" {
+			t.Fatalf("Unexpected key %s", key)
+		}
+	}
+
+	if all, _ := d.Scan("", "", 0); len(all) != 26 {
+		t.Fatalf("Expected 26 keys in a full scan, got %d", len(all))
 	}
 }
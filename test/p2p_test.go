@@ -0,0 +1,591 @@
+package node_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abdealijaroli/godfs/internal/discovery"
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+func TestTCPPeerBackToBackMessages(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sender := p2p.NewTCPPeer(client, true)
+	receiver := p2p.NewTCPPeer(server, false)
+
+	payload := []byte{0x00, 0xff, '"', '\n', 0x7f}
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := sender.Send(p2p.Message{Type: "dht_store", Payload: payload}); err != nil {
+				t.Errorf("Failed to send message %d: %v", i, err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		msg, err := receiver.Receive()
+		if err != nil {
+			t.Fatalf("Failed to receive message %d: %v", i, err)
+		}
+		if msg.Type != "dht_store" || !bytes.Equal(msg.Payload, payload) {
+			t.Fatalf("Unexpected message %d: %+v", i, msg)
+		}
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	msg := p2p.Message{
+		ID:        p2p.NewMessageID(),
+		Type:      "dht_store",
+		Payload:   []byte{0x00, 0x01, 0xfe},
+		Sender:    "localhost:9000",
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	for _, name := range []string{p2p.CodecJSON, p2p.CodecMsgpack, p2p.CodecProtobuf} {
+		codec, err := p2p.GetCodec(name)
+		if err != nil {
+			t.Fatalf("Failed to get codec %s: %v", name, err)
+		}
+
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal with %s: %v", name, err)
+		}
+
+		var decoded p2p.Message
+		if err := codec.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Failed to unmarshal with %s: %v", name, err)
+		}
+		if decoded.ID != msg.ID || decoded.Type != msg.Type || !bytes.Equal(decoded.Payload, msg.Payload) ||
+			decoded.Sender != msg.Sender || decoded.Timestamp != msg.Timestamp {
+			t.Fatalf("Codec %s returned %+v, expected %+v", name, decoded, msg)
+		}
+	}
+
+	if _, err := p2p.GetCodec("xml"); err == nil {
+		t.Fatal("Expected error for unknown codec")
+	}
+	if _, err := p2p.DeserializeMessage([]byte{0x00, 0x05, 'a'}); err == nil {
+		t.Fatal("Expected error for malformed message")
+	}
+}
+
+// starts a transport on an ephemeral port and waits for it to be bound
+func listenTCP(t *testing.T) (*p2p.TCPTransport, <-chan error) {
+	t.Helper()
+	tr := p2p.NewTCPTransport("127.0.0.1:0")
+	done := make(chan error, 1)
+	go func() { done <- tr.ListenAndAccept() }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.HasSuffix(tr.Addr(), ":0") {
+		if time.Now().After(deadline) {
+			t.Fatal("Transport did not start listening")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return tr, done
+}
+
+func TestTCPTransportBroadcastAndClose(t *testing.T) {
+	server, done := listenTCP(t)
+
+	var clients []p2p.Peer
+	for i := 0; i < 2; i++ {
+		peer, err := p2p.NewTCPTransport("").Dial(server.Addr())
+		if err != nil {
+			t.Fatalf("Failed to dial server: %v", err)
+		}
+		defer peer.Close()
+		clients = append(clients, peer)
+	}
+
+	// keep broadcasting until the server has registered both inbound peers
+	received := make(chan p2p.Message, 2)
+	for _, c := range clients {
+		go func(c p2p.Peer) {
+			msg, err := c.Receive()
+			if err == nil {
+				received <- msg
+			}
+		}(c)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for got := 0; got < 2; {
+		if err := server.Broadcast([]byte("announce")); err != nil {
+			t.Fatalf("Broadcast failed: %v", err)
+		}
+		select {
+		case msg := <-received:
+			if msg.Type != p2p.MessageTypeBroadcast || string(msg.Payload) != "announce" {
+				t.Fatalf("Unexpected message: %+v", msg)
+			}
+			got++
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("Broadcast never reached both peers")
+		}
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ListenAndAccept returned %v after Close", err)
+	}
+	// leftover announcements may still be buffered, the connection must end after them
+	for i := 0; ; i++ {
+		if _, err := clients[0].Receive(); err != nil {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Expected peer connection to be closed")
+		}
+	}
+	if err := server.Broadcast([]byte("announce")); !errors.Is(err, p2p.ErrTransportClosed) {
+		t.Fatalf("Expected ErrTransportClosed, got %v", err)
+	}
+}
+
+func TestTCPTransportHandlerReplies(t *testing.T) {
+	server, _ := listenTCP(t)
+	defer server.Close()
+
+	server.Handle("echo", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		return p2p.Message{Type: "echo_reply", Payload: msg.Payload}, nil
+	})
+	server.Handle("fail", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		return p2p.Message{}, errors.New("boom")
+	})
+
+	peer, err := p2p.NewTCPTransport("").Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer peer.Close()
+
+	for _, payload := range []string{"one", "two"} {
+		if err := peer.Send(p2p.Message{Type: "echo", Payload: []byte(payload)}); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	for _, want := range []string{"one", "two"} {
+		resp, err := peer.Receive()
+		if err != nil {
+			t.Fatalf("Failed to receive reply: %v", err)
+		}
+		if resp.Type != "echo_reply" || string(resp.Payload) != want {
+			t.Fatalf("Unexpected reply: %+v", resp)
+		}
+	}
+
+	if err := peer.Send(p2p.Message{Type: "fail"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	resp, err := peer.Receive()
+	if err != nil {
+		t.Fatalf("Failed to receive reply: %v", err)
+	}
+	if resp.Type != p2p.MessageTypeError || string(resp.Payload) != "boom" {
+		t.Fatalf("Unexpected error reply: %+v", resp)
+	}
+}
+
+func TestTCPSlowOneWayHandlerDoesNotBlockRequests(t *testing.T) {
+	server, _ := listenTCP(t)
+	defer server.Close()
+
+	release := make(chan struct{})
+	server.Handle("slow", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		<-release
+		return p2p.Message{}, nil
+	})
+	server.Handle("echo", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		return p2p.Message{Type: "echo_reply", Payload: msg.Payload}, nil
+	})
+	defer close(release)
+
+	peer, err := p2p.NewTCPTransport("").Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer peer.Close()
+
+	if err := peer.Send(p2p.Message{Type: "slow"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, msgType := range []string{p2p.MessageTypePing, "echo"} {
+		if _, err := peer.Request(ctx, p2p.Message{Type: msgType}); err != nil {
+			t.Fatalf("%s behind a slow one-way message failed: %v", msgType, err)
+		}
+	}
+}
+
+func TestTCPPeerRequest(t *testing.T) {
+	server, _ := listenTCP(t)
+	defer server.Close()
+
+	server.Handle("echo", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		return p2p.Message{Type: "echo_reply", Payload: msg.Payload}, nil
+	})
+	server.Handle("fail", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		return p2p.Message{}, errors.New("boom")
+	})
+
+	peer, err := p2p.NewTCPTransport("").Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer peer.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(payload string) {
+			defer wg.Done()
+			resp, err := peer.Request(context.Background(), p2p.Message{Type: "echo", Payload: []byte(payload)})
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			if resp.Type != "echo_reply" || string(resp.Payload) != payload {
+				t.Errorf("Unexpected reply for %s: %+v", payload, resp)
+			}
+		}(fmt.Sprintf("payload-%d", i))
+	}
+	wg.Wait()
+
+	_, err = peer.Request(context.Background(), p2p.Message{Type: "fail"})
+	if !errors.Is(err, p2p.ErrRemote) || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Expected remote error, got %v", err)
+	}
+
+	// nothing answers "ignored", the deadline must release the caller
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := peer.Request(ctx, p2p.Message{Type: "ignored"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestTCPTransportPoolReusesConnections(t *testing.T) {
+	server, _ := listenTCP(t)
+	defer server.Close()
+
+	client := p2p.NewTCPTransport("", p2p.WithMaxConnsPerAddr(1))
+	defer client.Close()
+
+	type addressed interface{ LocalAddr() string }
+
+	first, err := client.Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	firstAddr := first.(addressed).LocalAddr()
+
+	// the only slot is taken, the next Dial has to wait for the release
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Close()
+	}()
+
+	second, err := client.Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer second.Close()
+
+	if got := second.(addressed).LocalAddr(); got != firstAddr {
+		t.Fatalf("Expected pooled connection %s to be reused, got %s", firstAddr, got)
+	}
+}
+
+// issues a certificate for cn signed by the CA, or self-signed when ca is nil
+func issueCert(t *testing.T, cn string, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parent, signer := tmpl, any(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTCPTransportMutualTLS(t *testing.T) {
+	ca := issueCert(t, "godfs-ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	mtls := func(cn string) *tls.Config {
+		return &tls.Config{
+			Certificates: []tls.Certificate{issueCert(t, cn, &ca)},
+			RootCAs:      pool,
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	server := p2p.NewTCPTransport("127.0.0.1:0", p2p.WithTLSConfig(mtls("node1")))
+	go server.ListenAndAccept()
+	defer server.Close()
+	for strings.HasSuffix(server.Addr(), ":0") {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	server.Handle("whoami", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		return p2p.Message{Type: "you_are", Payload: []byte(p2p.PeerIdentity(peer))}, nil
+	})
+
+	client := p2p.NewTCPTransport("", p2p.WithTLSConfig(mtls("node2")))
+	defer client.Close()
+
+	peer, err := client.Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial over TLS: %v", err)
+	}
+	defer peer.Close()
+
+	if id := p2p.PeerIdentity(peer); id != "node1" {
+		t.Fatalf("Expected server identity node1, got %q", id)
+	}
+
+	resp, err := peer.Request(context.Background(), p2p.Message{Type: "whoami"})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(resp.Payload) != "node2" {
+		t.Fatalf("Expected server to see client identity node2, got %q", resp.Payload)
+	}
+
+	// a client without a certificate must be turned away
+	anonymous := p2p.NewTCPTransport("", p2p.WithTLSConfig(&tls.Config{RootCAs: pool}))
+	defer anonymous.Close()
+	if peer, err := anonymous.Dial(server.Addr()); err == nil {
+		peer.Close()
+		t.Fatal("Expected dial without client certificate to fail")
+	}
+}
+
+func TestMemTransportOneWayOrder(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	a := network.NewTransport("node1")
+	b := network.NewTransport("node2")
+	defer a.Close()
+	defer b.Close()
+
+	var lock sync.Mutex
+	var got []string
+	b.Handle("note", func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		got = append(got, string(msg.Payload))
+		return p2p.Message{}, nil
+	})
+
+	peer, err := a.Dial("node2")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer peer.Close()
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := peer.Send(p2p.Message{Type: "note", Payload: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+
+	// one-way messages are handled in the order they were sent, as over TCP
+	waitFor(t, "every message to be handled", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(got) == n
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	for i, payload := range got {
+		if payload != fmt.Sprint(i) {
+			t.Fatalf("Expected message %d, got %s", i, payload)
+		}
+	}
+}
+
+func TestFaultyTransportBroadcastAndSend(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	chaos := p2p.NewChaos(1)
+	a := chaos.Wrap(network.NewTransport("node1"))
+	b := network.NewTransport("node2")
+	c := network.NewTransport("node3")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	received := make(chan string, 4)
+	for _, tr := range []*p2p.MemTransport{b, c} {
+		addr := tr.Addr()
+		tr.Handle(p2p.MessageTypeBroadcast, func(peer p2p.Peer, msg p2p.Message) (p2p.Message, error) {
+			received <- addr
+			return p2p.Message{}, nil
+		})
+	}
+	connected := make(chan struct{}, 2)
+	a.OnPeerConnected(func(peer p2p.Peer) { connected <- struct{}{} })
+	toB, err := a.Dial("node2")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if _, err := a.Dial("node3"); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	<-connected
+	<-connected
+
+	// the partition applies to broadcasts like any other message
+	chaos.Partition("node1", "node3")
+	if err := a.Broadcast([]byte("hello")); !errors.Is(err, p2p.ErrUnreachable) {
+		t.Fatalf("Expected the partitioned peer to fail, got %v", err)
+	}
+	if addr := <-received; addr != "node2" {
+		t.Fatalf("Expected only node2 to receive the broadcast, got %s", addr)
+	}
+	select {
+	case addr := <-received:
+		t.Fatalf("Unexpected broadcast delivered to %s", addr)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	chaos.Partition("node1", "node2")
+	if err := toB.Send(p2p.Message{Type: "note"}); !errors.Is(err, p2p.ErrUnreachable) {
+		t.Fatalf("Expected Send across a partition to fail, got %v", err)
+	}
+	chaos.Heal("node1", "node2")
+	toB.Close()
+	if err := toB.Send(p2p.Message{Type: "note"}); !errors.Is(err, p2p.ErrPeerClosed) {
+		t.Fatalf("Expected Send on a closed peer to fail, got %v", err)
+	}
+}
+
+func TestHeartbeatEvictsUnresponsivePeers(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	heartbeat := p2p.WithMemHeartbeat(10*time.Millisecond, 20*time.Millisecond)
+	a := network.NewTransport("node1", heartbeat)
+	b := network.NewTransport("node2", heartbeat)
+	defer a.Close()
+	defer b.Close()
+
+	pd := discovery.NewPeerDiscovery()
+	pd.Track(a)
+
+	disconnected := make(chan string, 1)
+	a.OnPeerDisconnected(func(peer p2p.Peer) {
+		disconnected <- peer.RemoteAddr()
+	})
+
+	peer, err := a.Dial("node2")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer peer.Close()
+
+	// answered pings keep the connection up
+	time.Sleep(50 * time.Millisecond)
+	if peers := pd.GetPeers(); len(peers) != 1 || peers[0] != "node2" {
+		t.Fatalf("Expected node2 to be active, got %v", peers)
+	}
+
+	network.Partition("node1", "node2")
+	select {
+	case addr := <-disconnected:
+		if addr != "node2" {
+			t.Fatalf("Expected node2 to be evicted, got %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Unresponsive peer was never evicted")
+	}
+	if peers := pd.GetPeers(); len(peers) != 0 {
+		t.Fatalf("Expected no active peers, got %v", peers)
+	}
+}
+
+func TestTCPHeartbeatKeepsConnectionAlive(t *testing.T) {
+	server := p2p.NewTCPTransport("127.0.0.1:0", p2p.WithHeartbeat(10*time.Millisecond, 50*time.Millisecond))
+	go server.ListenAndAccept()
+	defer server.Close()
+	for strings.HasSuffix(server.Addr(), ":0") {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	connected := make(chan string, 1)
+	server.OnPeerConnected(func(peer p2p.Peer) {
+		connected <- peer.RemoteAddr()
+	})
+
+	client := p2p.NewTCPTransport("127.0.0.1:7000", p2p.WithHeartbeat(10*time.Millisecond, 50*time.Millisecond))
+	defer client.Close()
+	peer, err := client.Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer peer.Close()
+
+	select {
+	case addr := <-connected:
+		// the dialer advertises its listen address during the handshake
+		if addr != "127.0.0.1:7000" {
+			t.Fatalf("Expected advertised address, got %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Server never reported the connection")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := peer.Send(p2p.Message{Type: "still_here"}); err != nil {
+		t.Fatalf("Connection was dropped despite answered heartbeats: %v", err)
+	}
+}
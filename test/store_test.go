@@ -0,0 +1,118 @@
+package node_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abdealijaroli/godfs/internal/node"
+	"github.com/abdealijaroli/godfs/pkg/p2p"
+)
+
+// every engine, opened on dir so the durable ones can be reopened
+var storeEngines = map[string]func(t *testing.T, dir string) node.Store{
+	"mem": func(t *testing.T, dir string) node.Store {
+		return node.NewMemStore()
+	},
+	"wal": func(t *testing.T, dir string) node.Store {
+		s, err := node.OpenWALStore(dir, time.Hour)
+		if err != nil {
+			t.Fatalf("OpenWALStore failed: %v", err)
+		}
+		return s
+	},
+	"bolt": func(t *testing.T, dir string) node.Store {
+		s, err := node.OpenBoltStore(filepath.Join(dir, "data.db"))
+		if err != nil {
+			t.Fatalf("OpenBoltStore failed: %v", err)
+		}
+		return s
+	},
+}
+
+func TestStoreEngines(t *testing.T) {
+	for name, open := range storeEngines {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := open(t, dir)
+
+			entry := node.DataEntry{Value: "chunk1_location", Version: 1, Clock: node.VectorClock{"node1": 1}}
+			if err := s.Put("file1", entry); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			got, ok, err := s.Get("file1")
+			if err != nil || !ok || got.Value != entry.Value || got.Clock["node1"] != 1 {
+				t.Fatalf("Expected %+v, got %+v (%v, %v)", entry, got, ok, err)
+			}
+
+			var b node.Batch
+			for i := 0; i < 5; i++ {
+				b.Put(fmt.Sprintf("key-%d", i), node.DataEntry{Value: fmt.Sprint(i)})
+			}
+			b.Delete("file1")
+			if err := s.Batch(&b); err != nil {
+				t.Fatalf("Batch failed: %v", err)
+			}
+			if _, ok, _ := s.Get("file1"); ok {
+				t.Fatal("Expected file1 to be deleted by the batch")
+			}
+			if err := s.Delete("key-4"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+
+			// keys come back in order, starting at start
+			var keys []string
+			s.Iterate("key-1", func(key string, entry node.DataEntry) bool {
+				keys = append(keys, key)
+				return len(keys) < 2
+			})
+			if fmt.Sprint(keys) != "[key-1 key-2]" {
+				t.Fatalf("Unexpected iteration %v", keys)
+			}
+
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if name == "mem" {
+				return
+			}
+
+			s = open(t, dir)
+			defer s.Close()
+			keys = nil
+			s.Iterate("", func(key string, entry node.DataEntry) bool {
+				keys = append(keys, key)
+				return true
+			})
+			if fmt.Sprint(keys) != "[key-0 key-1 key-2 key-3]" {
+				t.Fatalf("Unexpected keys after reopening %v", keys)
+			}
+		})
+	}
+}
+
+func TestDHTOnBoltStore(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *node.DHT {
+		store, err := node.OpenBoltStore(filepath.Join(dir, "data.db"))
+		if err != nil {
+			t.Fatalf("OpenBoltStore failed: %v", err)
+		}
+		d, err := node.OpenDHT("node1", node.WithStore(store), node.WithTransport(p2p.NewMemNetwork().NewTransport("node1")))
+		if err != nil {
+			t.Fatalf("OpenDHT failed: %v", err)
+		}
+		return d
+	}
+
+	d := open()
+	d.PutLocal("file1", "chunk1_location")
+	d.Close()
+
+	d = open()
+	defer d.Close()
+	if value, err := d.GetLocal("file1"); err != nil || value != "chunk1_location" {
+		t.Fatalf("Expected chunk1_location after restart, got %q (%v)", value, err)
+	}
+}